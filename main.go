@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/algorinfo/rawstore/pkg/store"
 	"github.com/algorinfo/rawstore/pkg/volume"
@@ -30,6 +34,25 @@ var (
 	redisNS      = Env("RD_REDIS_NS", "RD")
 	streamNo     = Env("RD_STREAM", "false")
 	eStreamLimit = Env("RD_STREAM_LIMIT", "1000")
+	streamSink   = Env("RD_STREAM_SINK", "redis")
+	streamFile   = Env("RD_STREAM_FILE", "events.ndjson")
+	streamURL    = Env("RD_STREAM_URL", "")
+	journalMode  = Env("RD_SQLITE_JOURNAL", "WAL")
+	synchronous  = Env("RD_SQLITE_SYNC", "FULL")
+	busyTimeout  = Env("RD_SQLITE_BUSY_TIMEOUT", "5000")
+	cacheSize    = Env("RD_SQLITE_CACHE_SIZE", "-2000")
+	mmapSize     = Env("RD_SQLITE_MMAP_SIZE", "0")
+	maxReaders   = Env("RD_SQLITE_MAX_READERS", "4")
+	autoVacuum   = Env("RD_SQLITE_AUTO_VACUUM", "INCREMENTAL")
+	batchSize    = Env("RD_BATCH_SIZE", "100")
+	batchDelay   = Env("RD_BATCH_DELAY", "1ms")
+	maxBodySize  = Env("RD_MAX_BODY_SIZE", "67108864")
+	maxUpload    = Env("RD_MAX_UPLOAD_SIZE", "8589934592")
+	chunkSize    = Env("RD_CHUNK_SIZE", "1048576")
+	maxOpenNS    = Env("RD_MAX_OPEN_NS", "512")
+	idleTimeout  = Env("RD_NS_IDLE_TIMEOUT", "10m")
+	watchDir     = Env("RD_WATCH", "true")
+	changesKeep  = Env("RD_CHANGELOG_RETENTION", "168h")
 )
 
 func createNamespaceDir(path string) {
@@ -43,23 +66,76 @@ func createNamespaceDir(path string) {
 	}
 }
 
+// fsck checks the namespaces given, or every namespace in dir,
+// returns false if any of them has errors.
+func fsck(dir string, quarantine bool, namespaces []string) bool {
+	if len(namespaces) == 0 {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.db"))
+		for _, f := range files {
+			namespaces = append(namespaces, strings.TrimSuffix(filepath.Base(f), ".db"))
+		}
+	}
+	ok := true
+	for _, ns := range namespaces {
+		rep, err := volume.CheckFile(context.Background(), dir, ns, quarantine)
+		if err != nil {
+			fmt.Printf("%s: %s\n", ns, err)
+			ok = false
+			continue
+		}
+		for _, r := range append([]*volume.CheckReport{rep}, rep.Partitions...) {
+			fmt.Printf("%s: integrity %s, %d objects checked, %d bad, %d quarantined\n",
+				r.Namespace, strings.Join(r.Integrity, "; "), r.Checked, len(r.Bad), r.Quarantined)
+			for _, b := range r.Bad {
+				fmt.Printf("  %s: %s\n", b.Key, b.Reason)
+			}
+		}
+		ok = ok && rep.OK()
+	}
+	return ok
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	streamB, _ := strconv.ParseBool(streamNo)
+	watchB, _ := strconv.ParseBool(watchDir)
 
 	// commands
 	// brain deprecated for now, it was thought for a sharding strategy.
 	// brainCmd := flag.NewFlagSet("brain", flag.ExitOnError)
 	volumeCmd := flag.NewFlagSet("volume", flag.ExitOnError)
+	fsckCmd := flag.NewFlagSet("fsck", flag.ExitOnError)
 
 	// Params
 	// listen := brainCmd.String("listen", ":6665", "Address to listen")
 	listenV := volumeCmd.String("listen", listenAddr, "Address to listen")
 	pnsDir := volumeCmd.String("namespace", nsDir, "Namespace dir")
-	stream := volumeCmd.Bool("stream", streamB, "Enable stream data to redis")
+	stream := volumeCmd.Bool("stream", streamB, "Enable stream of the change events")
+	streamSinkV := volumeCmd.String("stream-sink", streamSink, "Where the events are sent: redis, file or http")
+	streamFileV := volumeCmd.String("stream-file", streamFile, "File where the events are appended with -stream-sink file")
+	streamURLV := volumeCmd.String("stream-url", streamURL, "URL where the events are posted with -stream-sink http")
 	streamLimit := volumeCmd.String("stream-limit", eStreamLimit, "How many message by stream")
 	streamNSC := volumeCmd.String("redis-ns", redisNS, "Which key namespace use for redis")
+	journalV := volumeCmd.String("journal-mode", journalMode, "SQLite journal mode (WAL, DELETE, ...)")
+	syncV := volumeCmd.String("synchronous", synchronous, "SQLite synchronous level (OFF, NORMAL, FULL, EXTRA)")
+	busyV := volumeCmd.String("busy-timeout", busyTimeout, "SQLite busy timeout in milliseconds")
+	cacheV := volumeCmd.String("cache-size", cacheSize, "SQLite cache_size by connection, negative values are KiB")
+	mmapV := volumeCmd.String("mmap-size", mmapSize, "SQLite mmap_size in bytes, 0 disables it")
+	readersV := volumeCmd.String("max-readers", maxReaders, "Max read connections by namespace")
+	autoVacuumV := volumeCmd.String("auto-vacuum", autoVacuum, "SQLite auto_vacuum for new namespaces (NONE, FULL, INCREMENTAL)")
+	batchSizeV := volumeCmd.String("batch-size", batchSize, "Max writes committed in the same transaction")
+	batchDelayV := volumeCmd.String("batch-delay", batchDelay, "Max time to wait for more writes before committing")
+	maxBodyV := volumeCmd.String("max-body-size", maxBodySize, "Max size in bytes of an object, 0 means no limit")
+	maxUploadV := volumeCmd.String("max-upload-size", maxUpload, "Max size in bytes of an uploaded namespace file, 0 means no limit")
+	chunkSizeV := volumeCmd.String("chunk-size", chunkSize, "Objects bigger than this are stored in chunks of this size, 0 disables it")
+	maxOpenV := volumeCmd.String("max-open", maxOpenNS, "Max namespaces open, the least recently used are closed, 0 means no limit")
+	watchV := volumeCmd.Bool("watch", watchB, "Register the namespace files added or removed from the namespace dir")
+	idleV := volumeCmd.String("idle-timeout", idleTimeout, "Close the namespaces not used for this time, 0 disables it")
+	changesKeepV := volumeCmd.String("changelog-retention", changesKeep, "Remove the changes older than this from the changelog, 0 keeps them")
+
+	fsckDir := fsckCmd.String("namespace", nsDir, "Namespace dir")
+	fsckQuarantine := fsckCmd.Bool("quarantine", false, "Move the bad objects to the quarantine table")
 
 	flag.Parse()
 	if len(os.Args) < 2 {
@@ -90,44 +166,100 @@ func main() {
 
 		// rt, _ := strconv.Atoi(rateLimit)
 
+		busy, _ := strconv.Atoi(*busyV)
+		cache, _ := strconv.Atoi(*cacheV)
+		mmap, _ := strconv.ParseInt(*mmapV, 10, 64)
+		readers, _ := strconv.Atoi(*readersV)
+		writerOpts := store.DefaultWriterOptions()
+		if bs, err := strconv.Atoi(*batchSizeV); err == nil && bs > 0 {
+			writerOpts.MaxBatch = bs
+		}
+		if bd, err := time.ParseDuration(*batchDelayV); err == nil {
+			writerOpts.MaxDelay = bd
+		}
+
+		maxBody, _ := strconv.ParseInt(*maxBodyV, 10, 64)
+		maxUploadSize, _ := strconv.ParseInt(*maxUploadV, 10, 64)
+		chunk, _ := strconv.ParseInt(*chunkSizeV, 10, 64)
+		maxOpen, _ := strconv.Atoi(*maxOpenV)
+		idle, _ := time.ParseDuration(*idleV)
+		changesRetention, _ := time.ParseDuration(*changesKeepV)
+
 		cfg := &volume.Config{
 			Addr: *listenV,
 			// RateLimit: rt,
-			NSDir: *pnsDir,
+			NSDir:         *pnsDir,
+			MaxBodySize:   maxBody,
+			MaxUploadSize: maxUploadSize,
+			ChunkSize:     chunk,
+			MaxOpenNS:     maxOpen,
+			IdleTimeout:   idle,
+			Watch:         *watchV,
+
+			ChangelogRetention: changesRetention,
+			SQLite: &store.SQLiteOptions{
+				JournalMode: *journalV,
+				Synchronous: *syncV,
+				BusyTimeout: busy,
+				CacheSize:   cache,
+				MmapSize:    mmap,
+				MaxReaders:  readers,
+				AutoVacuum:  *autoVacuumV,
+			},
+			Writer: writerOpts,
 		}
 		createNamespaceDir(cfg.NSDir)
 
 		// store.UseDB()
 
+		opts := []volume.WebOption{volume.WithConfig(cfg)}
 		if *stream {
-			intDb, _ := strconv.Atoi(redisDB)
-			maxLen, _ := strconv.ParseInt(*streamLimit, 10, 64)
-			p := store.NewProducer(store.WithRedis(
-				&store.Redis{Conn: &store.Connection{
-					Addr:     redisAddr,
-					Password: redisPass,
-					DB:       intDb,
-				},
-				},
-			),
-				store.WithMaxLen(maxLen),
-			)
-			p.Namespace = *streamNSC
-			p.RDB.Connect()
-			vol := volume.New(
-				volume.WithConfig(cfg),
-				volume.WithProducer(p),
-			)
-			vol.Run()
-		} else {
-			vol := volume.New(
-				volume.WithConfig(cfg),
-			)
-			vol.Run()
+			var p store.Publisher
+			switch *streamSinkV {
+			case "redis":
+				intDb, _ := strconv.Atoi(redisDB)
+				maxLen, _ := strconv.ParseInt(*streamLimit, 10, 64)
+				producer := store.NewProducer(store.WithRedis(
+					&store.Redis{Conn: &store.Connection{
+						Addr:     redisAddr,
+						Password: redisPass,
+						DB:       intDb,
+					},
+					},
+				),
+					store.WithMaxLen(maxLen),
+				)
+				producer.Namespace = *streamNSC
+				producer.RDB.Connect()
+				p = producer
+			case "file":
+				if p, err = store.NewFilePublisher(*streamFileV); err != nil {
+					log.Fatalln(err)
+				}
+			case "http":
+				if *streamURLV == "" {
+					log.Fatalln("-stream-url is required with -stream-sink http")
+				}
+				p = store.NewHTTPPublisher(*streamURLV)
+			default:
+				log.Fatalf("Unknown stream sink %q", *streamSinkV)
+			}
+			opts = append(opts, volume.WithPublisher(p))
+		}
+		vol := volume.New(opts...)
+		vol.Run()
+
+	case "fsck":
+		err := fsckCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Fatal("Error parsing args")
+		}
+		if !fsck(*fsckDir, *fsckQuarantine, fsckCmd.Args()) {
+			os.Exit(1)
 		}
 
 	default:
-		fmt.Printf("Please use the 'volume' command")
+		fmt.Printf("Please use the 'volume' or 'fsck' command")
 	}
 
 }
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Publisher sends the change events of the namespaces to a sink.
+// An event is retried until Publish returns nil, so the sinks should be
+// ready to receive the same event more than once.
+type Publisher interface {
+	// Publish sends the fields of an event of the namespace ns
+	Publish(ctx context.Context, ns string, values map[string]interface{}) error
+	Close() error
+}
+
+// Publish adds the event to the stream {Namespace}.{ns}
+func (p *Producer) Publish(ctx context.Context, ns string, values map[string]interface{}) error {
+	return p.SendTo(ctx, fmt.Sprintf("%s.%s", p.Namespace, ns), values)
+}
+
+// Close the redis client is shared, so it's not closed
+func (p *Producer) Close() error {
+	return nil
+}
+
+// FilePublisher appends the events to a file, one JSON object by line
+type FilePublisher struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFilePublisher opens or creates the file at path
+func NewFilePublisher(path string) (*FilePublisher, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FilePublisher{f: f}, nil
+}
+
+// Publish the line is synced before returning, so an event published
+// is not lost if the volume stops.
+func (p *FilePublisher) Publish(ctx context.Context, ns string, values map[string]interface{}) error {
+	b, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return p.f.Sync()
+}
+
+func (p *FilePublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.f.Close()
+}
+
+// HTTPPublisher posts each event as JSON to an url, any status
+// but 2xx is an error.
+type HTTPPublisher struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewHTTPPublisher(url string) *HTTPPublisher {
+	return &HTTPPublisher{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *HTTPPublisher) Publish(ctx context.Context, ns string, values map[string]interface{}) error {
+	b, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rsp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(rsp.Body, 64<<10))
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("status %d from %s", rsp.StatusCode, p.URL)
+	}
+	return nil
+}
+
+func (p *HTTPPublisher) Close() error {
+	p.Client.CloseIdleConnections()
+	return nil
+}
+
+// Message an event kept by MemoryPublisher
+type Message struct {
+	Namespace string
+	Values    map[string]interface{}
+}
+
+// MemoryPublisher keeps the events in memory, used in tests
+type MemoryPublisher struct {
+	mu       sync.Mutex
+	messages []Message
+	err      error
+}
+
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+func (p *MemoryPublisher) Publish(ctx context.Context, ns string, values map[string]interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.messages = append(p.messages, Message{Namespace: ns, Values: values})
+	return nil
+}
+
+// Fail makes Publish return err, nil makes it work again
+func (p *MemoryPublisher) Fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+// Messages published until now
+func (p *MemoryPublisher) Messages() []Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Message{}, p.messages...)
+}
+
+func (p *MemoryPublisher) Close() error {
+	return nil
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilePublisher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	p, err := NewFilePublisher(path)
+	assert.Nil(t, err)
+	ctx := context.Background()
+	assert.Nil(t, p.Publish(ctx, "default", map[string]interface{}{"type": "created", "path": "a"}))
+	assert.Nil(t, p.Publish(ctx, "default", map[string]interface{}{"type": "deleted", "path": "a"}))
+	assert.Nil(t, p.Close())
+
+	b, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 2)
+	var v map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &v))
+	assert.Equal(t, "deleted", v["type"])
+}
+
+func TestHTTPPublisher(t *testing.T) {
+	bodies := []string{}
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	var p Publisher = NewHTTPPublisher(srv.URL)
+	defer p.Close()
+	assert.Nil(t, p.Publish(context.Background(), "default", map[string]interface{}{"path": "a"}))
+	assert.Equal(t, []string{`{"path":"a"}`}, bodies)
+
+	status = http.StatusBadGateway
+	assert.NotNil(t, p.Publish(context.Background(), "default", map[string]interface{}{"path": "b"}))
+}
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Snapshot writes a consistent copy of the file to dst with the sqlite
+// backup API, including the changes still in the WAL. The copy is done in
+// a read transaction of a reader, so the writes are not blocked.
+func (db *DB) Snapshot(ctx context.Context, dst string) error {
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(dc interface{}) error {
+		src, ok := dc.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected connection %T", dc)
+		}
+		drv := &sqlite3.SQLiteDriver{}
+		c, err := drv.Open(dst)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		bk, err := c.(*sqlite3.SQLiteConn).Backup("main", src, "main")
+		if err != nil {
+			return err
+		}
+		if _, err := bk.Step(-1); err != nil {
+			bk.Close()
+			return err
+		}
+		return bk.Finish()
+	})
+}
@@ -1,6 +1,8 @@
 package store
 
 import (
+	"context"
+	"database/sql/driver"
 	"fmt"
 	"log"
 
@@ -69,3 +71,235 @@ func Backup(dbSrc, dbDst string) {
 	}
 
 }
+
+// SQLiteOptions connection settings for a sqlite store.
+// Empty values are not applied, so the sqlite defaults are used.
+type SQLiteOptions struct {
+	JournalMode string `json:"journalMode,omitempty"`
+	Synchronous string `json:"synchronous,omitempty"`
+	// BusyTimeout in milliseconds
+	BusyTimeout int `json:"busyTimeout,omitempty"`
+	// CacheSize as PRAGMA cache_size, negative values are KiB
+	CacheSize  int   `json:"cacheSize,omitempty"`
+	MmapSize   int64 `json:"mmapSize,omitempty"`
+	MaxReaders int   `json:"maxReaders,omitempty"`
+	// AutoVacuum (NONE, FULL, INCREMENTAL) only takes effect on new
+	// files or after a full VACUUM.
+	AutoVacuum string `json:"autoVacuum,omitempty"`
+	// ReadOnly opens the file with mode=ro, Immutable also tells sqlite
+	// that nobody changes the file, so it isn't locked.
+	ReadOnly  bool `json:"-"`
+	Immutable bool `json:"-"`
+}
+
+// DefaultSQLiteOptions WAL with a single writer and a pool of readers.
+// Synchronous is FULL, so an acknowledged commit survives a power failure,
+// with NORMAL the writes are faster but the last commits could be lost.
+func DefaultSQLiteOptions() *SQLiteOptions {
+	return &SQLiteOptions{
+		JournalMode: "WAL",
+		Synchronous: "FULL",
+		BusyTimeout: 5000,
+		CacheSize:   -2000,
+		MaxReaders:  4,
+		AutoVacuum:  "INCREMENTAL",
+	}
+}
+
+// Merge returns a copy of o with the non empty values of other
+func (o *SQLiteOptions) Merge(other *SQLiteOptions) *SQLiteOptions {
+	m := *o
+	if other == nil {
+		return &m
+	}
+	if other.JournalMode != "" {
+		m.JournalMode = other.JournalMode
+	}
+	if other.Synchronous != "" {
+		m.Synchronous = other.Synchronous
+	}
+	if other.BusyTimeout != 0 {
+		m.BusyTimeout = other.BusyTimeout
+	}
+	if other.CacheSize != 0 {
+		m.CacheSize = other.CacheSize
+	}
+	if other.MmapSize != 0 {
+		m.MmapSize = other.MmapSize
+	}
+	if other.MaxReaders != 0 {
+		m.MaxReaders = other.MaxReaders
+	}
+	if other.AutoVacuum != "" {
+		m.AutoVacuum = other.AutoVacuum
+	}
+	return &m
+}
+
+// pragmas executed on each new connection
+func (o *SQLiteOptions) pragmas(writer bool) []string {
+	p := []string{}
+	if o.ReadOnly {
+		// nothing could be changed in the file
+		writer = false
+	}
+	if writer && o.AutoVacuum != "" {
+		// it must be set before the tables are created
+		p = append(p, fmt.Sprintf("PRAGMA auto_vacuum = %s", o.AutoVacuum))
+	}
+	if o.BusyTimeout != 0 {
+		p = append(p, fmt.Sprintf("PRAGMA busy_timeout = %d", o.BusyTimeout))
+	}
+	if writer && o.JournalMode != "" {
+		// journal mode is persistent in the file, only the writer changes it.
+		p = append(p, fmt.Sprintf("PRAGMA journal_mode = %s", o.JournalMode))
+	}
+	if o.Synchronous != "" {
+		p = append(p, fmt.Sprintf("PRAGMA synchronous = %s", o.Synchronous))
+	}
+	if o.CacheSize != 0 {
+		p = append(p, fmt.Sprintf("PRAGMA cache_size = %d", o.CacheSize))
+	}
+	if o.MmapSize != 0 {
+		p = append(p, fmt.Sprintf("PRAGMA mmap_size = %d", o.MmapSize))
+	}
+	if !writer {
+		p = append(p, "PRAGMA query_only = 1")
+	}
+	return p
+}
+
+// connector opens sqlite connections executing the pragmas of each one.
+type connector struct {
+	dsn     string
+	pragmas []string
+	driver  *sqlite3.SQLiteDriver
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range c.pragmas {
+		if _, err := conn.(*sqlite3.SQLiteConn).Exec(p, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+/*
+DB a sqlite store with a pool of connections for reads and only
+one connection for writes. The reader pool is embedded so queries
+could be done directly, every write should go through W.
+*/
+type DB struct {
+	*sqlx.DB
+	W      *sqlx.DB
+	Path   string
+	Writer *Writer
+	// ReadOnly the file was opened read only, W fails on writes
+	ReadOnly bool
+}
+
+// StartWriter enables group commits for the writes done with Write
+func (db *DB) StartWriter(opts *WriterOptions) {
+	db.Writer = NewWriter(db.W, opts)
+}
+
+// Write executes fn in a transaction, if the writer is started
+// fn is queued and committed with other writes.
+func (db *DB) Write(ctx context.Context, fn WriteFunc) error {
+	if db.Writer != nil {
+		return db.Writer.Do(ctx, fn)
+	}
+	tx, err := db.W.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// OpenDB opens (or creates) the sqlite file dbName.db with opts
+func OpenDB(dbName string, opts *SQLiteOptions) (*DB, error) {
+	path := fmt.Sprintf("%s.db", dbName)
+	drv := &sqlite3.SQLiteDriver{}
+	if opts.ReadOnly {
+		return openReadOnly(path, opts, drv)
+	}
+
+	w := sqlx.NewDb(sql.OpenDB(&connector{
+		dsn:     path + "?_txlock=immediate",
+		pragmas: opts.pragmas(true),
+		driver:  drv,
+	}), "sqlite3")
+	w.SetMaxOpenConns(1)
+	if err := w.Ping(); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	r := sqlx.NewDb(sql.OpenDB(&connector{
+		dsn:     path,
+		pragmas: opts.pragmas(false),
+		driver:  drv,
+	}), "sqlite3")
+	readers := opts.MaxReaders
+	if readers <= 0 {
+		readers = 1
+	}
+	r.SetMaxOpenConns(readers)
+	r.SetMaxIdleConns(readers)
+
+	return &DB{DB: r, W: w, Path: path}, nil
+}
+
+// openReadOnly opens an existing file without a writer connection,
+// W is the same pool of readers.
+func openReadOnly(path string, opts *SQLiteOptions, drv *sqlite3.SQLiteDriver) (*DB, error) {
+	dsn := "file:" + path + "?mode=ro"
+	if opts.Immutable {
+		dsn += "&immutable=1"
+	}
+	r := sqlx.NewDb(sql.OpenDB(&connector{
+		dsn:     dsn,
+		pragmas: opts.pragmas(false),
+		driver:  drv,
+	}), "sqlite3")
+	readers := opts.MaxReaders
+	if readers <= 0 {
+		readers = 1
+	}
+	r.SetMaxOpenConns(readers)
+	r.SetMaxIdleConns(readers)
+	if err := r.Ping(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &DB{DB: r, W: r, Path: path, ReadOnly: true}, nil
+}
+
+// Close closes readers and the writer
+func (db *DB) Close() error {
+	if db.Writer != nil {
+		db.Writer.Close()
+	}
+	err := db.DB.Close()
+	if db.W == db.DB {
+		return err
+	}
+	if werr := db.W.Close(); werr != nil {
+		err = werr
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenDB(t *testing.T) {
+	opts := DefaultSQLiteOptions().Merge(&SQLiteOptions{BusyTimeout: 1234})
+	db, err := OpenDB(filepath.Join(t.TempDir(), "test"), opts)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	var mode string
+	db.W.Get(&mode, "PRAGMA journal_mode")
+	assert.Equal(t, "wal", mode)
+
+	var timeout int
+	db.Get(&timeout, "PRAGMA busy_timeout")
+	assert.Equal(t, 1234, timeout)
+
+	// FULL, acknowledged commits survive a power failure
+	var sync int
+	db.W.Get(&sync, "PRAGMA synchronous")
+	assert.Equal(t, 2, sync)
+
+	db.W.MustExec("CREATE TABLE t (id INTEGER)")
+	_, err = db.Exec("INSERT INTO t VALUES (1)")
+	assert.NotNil(t, err, "readers should be query only")
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenDB(filepath.Join(dir, "test"), DefaultSQLiteOptions())
+	assert.Nil(t, err)
+	defer db.Close()
+	db.W.MustExec("CREATE TABLE t (id INTEGER)")
+	db.W.MustExec("INSERT INTO t VALUES (1), (2)")
+
+	assert.Nil(t, db.Snapshot(context.Background(), filepath.Join(dir, "copy.db")))
+	cp, err := OpenDB(filepath.Join(dir, "copy"), DefaultSQLiteOptions())
+	assert.Nil(t, err)
+	defer cp.Close()
+	var n int
+	cp.Get(&n, "SELECT count(*) FROM t")
+	assert.Equal(t, 2, n)
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// Vacuum rebuilds the file releasing the free pages, and truncates
+// the WAL so the space is returned to the filesystem. It waits for the
+// writer connection, so it doesn't run in the middle of a batch.
+func (db *DB) Vacuum(ctx context.Context) error {
+	if _, err := db.W.ExecContext(ctx, "VACUUM"); err != nil {
+		return err
+	}
+	return db.Checkpoint(ctx)
+}
+
+// IncrementalVacuum releases up to pages free pages, 0 releases all of them.
+// The file should have auto_vacuum = INCREMENTAL.
+func (db *DB) IncrementalVacuum(ctx context.Context, pages int) error {
+	var mode int
+	if err := db.W.GetContext(ctx, &mode, "PRAGMA auto_vacuum"); err != nil {
+		return err
+	}
+	// 2 is INCREMENTAL
+	if mode != 2 {
+		return fmt.Errorf("auto_vacuum of %s is not INCREMENTAL", db.Path)
+	}
+	// each step of the pragma releases one page, so all the rows are consumed
+	rows, err := db.W.QueryContext(ctx, fmt.Sprintf("PRAGMA incremental_vacuum(%d)", pages))
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	return db.Checkpoint(ctx)
+}
+
+// Checkpoint moves the WAL to the main file and truncates it
+func (db *DB) Checkpoint(ctx context.Context) error {
+	_, err := db.W.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
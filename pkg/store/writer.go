@@ -0,0 +1,242 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrWriterClosed the writer doesn't accept more writes
+var ErrWriterClosed = errors.New("writer closed")
+
+// WriteFunc a write executed inside the transaction of a batch
+type WriteFunc func(ctx context.Context, tx *sqlx.Tx) error
+
+type writeOp struct {
+	ctx  context.Context
+	fn   WriteFunc
+	done chan error
+}
+
+// WriterOptions limits of each batch
+type WriterOptions struct {
+	// MaxBatch max writes by transaction
+	MaxBatch int
+	// MaxDelay how long the writer waits for more writes before committing
+	MaxDelay time.Duration
+	// QueueSize writes waiting to be processed before blocking the callers
+	QueueSize int
+}
+
+// DefaultWriterOptions batches up to 100 writes waiting at most 1ms
+func DefaultWriterOptions() *WriterOptions {
+	return &WriterOptions{
+		MaxBatch:  100,
+		MaxDelay:  time.Millisecond,
+		QueueSize: 1000,
+	}
+}
+
+// WriterStats metrics of a writer
+type WriterStats struct {
+	Batches    int64   `json:"batches"`
+	Writes     int64   `json:"writes"`
+	Failed     int64   `json:"failed"`
+	LastBatch  int     `json:"lastBatch"`
+	MaxBatch   int     `json:"maxBatch"`
+	AvgBatch   float64 `json:"avgBatch"`
+	QueueDepth int     `json:"queueDepth"`
+}
+
+/*
+Writer collects writes from a channel and commits them in groups,
+so many writes share the same transaction (and fsync).
+Each write runs inside a SAVEPOINT, if it fails only that write is
+rolled back, and the caller is answered only after the commit.
+*/
+type Writer struct {
+	db   *sqlx.DB
+	opts *WriterOptions
+	ops  chan *writeOp
+	quit chan struct{}
+	// stopped is closed when run exits
+	stopped chan struct{}
+	mu      sync.Mutex
+	stats   WriterStats
+	once    sync.Once
+}
+
+// NewWriter starts a writer over db, db should have only one connection
+func NewWriter(db *sqlx.DB, opts *WriterOptions) *Writer {
+	if opts == nil {
+		opts = DefaultWriterOptions()
+	}
+	w := &Writer{
+		db:      db,
+		opts:    opts,
+		ops:     make(chan *writeOp, opts.QueueSize),
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Do queues fn and waits until its batch is committed. Once fn is queued
+// Do waits for its result even if ctx is cancelled, because it could still
+// be committed; a write not started yet when ctx is cancelled is skipped.
+func (w *Writer) Do(ctx context.Context, fn WriteFunc) error {
+	op := &writeOp{ctx: ctx, fn: fn, done: make(chan error, 1)}
+	select {
+	case <-w.quit:
+		return ErrWriterClosed
+	default:
+	}
+	select {
+	case w.ops <- op:
+	case <-w.quit:
+		return ErrWriterClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-op.done:
+		return err
+	case <-w.stopped:
+		// it could be answered just before stopping
+		select {
+		case err := <-op.done:
+			return err
+		default:
+			return ErrWriterClosed
+		}
+	}
+}
+
+// Stats returns a copy of the metrics of the writer
+func (w *Writer) Stats() WriterStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.stats
+	s.QueueDepth = len(w.ops)
+	if s.Batches > 0 {
+		s.AvgBatch = float64(s.Writes) / float64(s.Batches)
+	}
+	return s
+}
+
+// Close waits for the queued writes and stops the writer
+func (w *Writer) Close() {
+	w.once.Do(func() {
+		close(w.quit)
+		<-w.stopped
+	})
+}
+
+func (w *Writer) run() {
+	defer close(w.stopped)
+	for {
+		select {
+		case op := <-w.ops:
+			w.commit(w.collect(op))
+		case <-w.quit:
+			// drain what is already queued
+			for {
+				select {
+				case op := <-w.ops:
+					w.commit(w.collect(op))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// collect groups the first op with the following ones until the batch
+// is full or MaxDelay is reached.
+func (w *Writer) collect(first *writeOp) []*writeOp {
+	batch := []*writeOp{first}
+	var timeout <-chan time.Time
+	if w.opts.MaxDelay > 0 {
+		timer := time.NewTimer(w.opts.MaxDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for len(batch) < w.opts.MaxBatch {
+		select {
+		case op := <-w.ops:
+			batch = append(batch, op)
+			continue
+		default:
+		}
+		if timeout == nil {
+			break
+		}
+		select {
+		case op := <-w.ops:
+			batch = append(batch, op)
+			continue
+		case <-timeout:
+		}
+		break
+	}
+	return batch
+}
+
+func (w *Writer) commit(batch []*writeOp) {
+	errs := make([]error, len(batch))
+	tx, err := w.db.Beginx()
+	if err == nil {
+		for i, op := range batch {
+			errs[i] = runOp(tx, op)
+		}
+		err = tx.Commit()
+		if err != nil {
+			tx.Rollback()
+		}
+	}
+
+	failed := 0
+	for i, op := range batch {
+		if err != nil {
+			errs[i] = err
+		}
+		if errs[i] != nil {
+			failed++
+		}
+		op.done <- errs[i]
+	}
+
+	w.mu.Lock()
+	w.stats.Batches++
+	w.stats.Writes += int64(len(batch))
+	w.stats.Failed += int64(failed)
+	w.stats.LastBatch = len(batch)
+	if len(batch) > w.stats.MaxBatch {
+		w.stats.MaxBatch = len(batch)
+	}
+	w.mu.Unlock()
+}
+
+// runOp executes one write inside a savepoint
+func runOp(tx *sqlx.Tx, op *writeOp) error {
+	if err := op.ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("SAVEPOINT op"); err != nil {
+		return err
+	}
+	// the context of the caller is not used by the statements, if it's
+	// cancelled sqlite interrupts the statement and the whole batch is rolled back.
+	if err := op.fn(context.Background(), tx); err != nil {
+		tx.Exec("ROLLBACK TO op")
+		tx.Exec("RELEASE op")
+		return err
+	}
+	_, err := tx.Exec("RELEASE op")
+	return err
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriterBatches(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "test"), DefaultSQLiteOptions())
+	assert.Nil(t, err)
+	db.W.MustExec("CREATE TABLE t (id INTEGER PRIMARY KEY)")
+	db.StartWriter(&WriterOptions{MaxBatch: 50, MaxDelay: 5 * time.Millisecond, QueueSize: 100})
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.Write(context.Background(), func(ctx context.Context, tx *sqlx.Tx) error {
+				if i == 7 {
+					tx.ExecContext(ctx, "INSERT INTO t VALUES (?)", 1000)
+					return errors.New("rollback only this write")
+				}
+				_, err := tx.ExecContext(ctx, "INSERT INTO t VALUES (?)", i)
+				return err
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if i == 7 {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+	var n int
+	db.Get(&n, "SELECT count(*) FROM t")
+	assert.Equal(t, 99, n)
+
+	st := db.Writer.Stats()
+	assert.Equal(t, int64(100), st.Writes)
+	assert.Equal(t, int64(1), st.Failed)
+	assert.Less(t, st.Batches, int64(100))
+}
+
+func TestWriterCancelled(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "test"), DefaultSQLiteOptions())
+	assert.Nil(t, err)
+	db.W.MustExec("CREATE TABLE t (id INTEGER PRIMARY KEY)")
+	db.StartWriter(DefaultWriterOptions())
+	defer db.Close()
+
+	// cancelled while it runs, the write is committed and Do reports it
+	ctx, cancel := context.WithCancel(context.Background())
+	err = db.Write(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err != nil {
+			return err
+		}
+		cancel()
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+	assert.Nil(t, err)
+	var n int
+	db.Get(&n, "SELECT count(*) FROM t")
+	assert.Equal(t, 1, n)
+
+	// cancelled before it runs, it's skipped
+	err = db.Write(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO t VALUES (2)")
+		return err
+	})
+	assert.True(t, errors.Is(err, context.Canceled))
+	db.Get(&n, "SELECT count(*) FROM t")
+	assert.Equal(t, 1, n)
+}
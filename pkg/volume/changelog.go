@@ -0,0 +1,458 @@
+package volume
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// changesLimit default and max changes returned by request
+	changesLimit    = 100
+	changesMaxLimit = 1000
+	// changesMaxWait max time a long poll waits for new changes, it's
+	// shorter than drainTimeout so a long poll doesn't keep a mode change
+	// or a partition drop waiting
+	changesMaxWait = 25 * time.Second
+	// changesPruneInterval how often old changes are removed
+	changesPruneInterval = 10 * time.Minute
+)
+
+/*
+changelog gives the sequence numbers of the changes of a namespace.
+A number is allocated inside the transaction of the change, and the
+transactions of different partitions could commit out of order, so only the
+changes up to the first number still in flight are visible. This way a
+consumer which saw the change N never misses a change lower than N.
+*/
+type changelog struct {
+	mu       sync.Mutex
+	last     int64
+	pruned   int64
+	inflight map[int64]struct{}
+	// notify is closed and replaced when changes are committed
+	notify chan struct{}
+}
+
+// changelogState saved in the settings of the main file
+type changelogState struct {
+	// Pruned the changes up to this one could have been removed
+	Pruned int64 `json:"pruned"`
+}
+
+func newChangelog(last, pruned int64) *changelog {
+	if pruned > last {
+		last = pruned
+	}
+	return &changelog{
+		last:     last,
+		pruned:   pruned,
+		inflight: map[int64]struct{}{},
+		notify:   make(chan struct{}),
+	}
+}
+
+// alloc next sequence number, done should be called once the
+// transaction finishes.
+func (c *changelog) alloc() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last++
+	c.inflight[c.last] = struct{}{}
+	return c.last
+}
+
+// done the transactions of the numbers were committed or discarded
+func (c *changelog) done(seqs ...int64) {
+	if len(seqs) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, seq := range seqs {
+		delete(c.inflight, seq)
+	}
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+// stable last number which could be read
+func (c *changelog) stable() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.last
+	for seq := range c.inflight {
+		if seq-1 < s {
+			s = seq - 1
+		}
+	}
+	return s
+}
+
+// changed is closed on the next commit
+func (c *changelog) changed() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.notify
+}
+
+// lastSeq last number allocated, committed or not
+func (c *changelog) lastSeq() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+func (c *changelog) prunedSeq() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pruned
+}
+
+// changelog of a namespace, it's loaded from the files on the first use
+// and kept while the namespace is closed. The namespace isn't opened, so
+// it returns nil if it's closed and the changelog wasn't loaded yet.
+func (wa *WebApp) changelog(ns string) *changelog {
+	wa.mu.RLock()
+	h, ok := wa.dbs[ns]
+	var cl *changelog
+	var base *store.DB
+	if ok {
+		cl, base = h.changes, h.db
+	}
+	wa.mu.RUnlock()
+	if !ok || cl != nil || base == nil {
+		return cl
+	}
+
+	cl, err := wa.loadChangelog(context.Background(), ns, base)
+	if err != nil {
+		log.Printf("Error loading changelog of %s: %s", ns, err)
+		return nil
+	}
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	if h.changes == nil {
+		h.changes = cl
+	}
+	return h.changes
+}
+
+// loadChangelog the last number is the highest one of the open files
+// of the namespace, base is its main file.
+func (wa *WebApp) loadChangelog(ctx context.Context, ns string, base *store.DB) (*changelog, error) {
+	var st changelogState
+	if _, err := getSetting(ctx, base, "changelog", &st); err != nil {
+		return nil, err
+	}
+	dbs := []*store.DB{base}
+	wa.mu.RLock()
+	p := wa.parts[ns]
+	wa.mu.RUnlock()
+	if p != nil {
+		p.mu.RLock()
+		for _, db := range p.dbs {
+			dbs = append(dbs, db)
+		}
+		p.mu.RUnlock()
+	}
+	var last int64
+	for _, db := range dbs {
+		var n int64
+		if err := db.GetContext(ctx, &n, "SELECT coalesce(max(seq), 0) FROM changes"); err != nil {
+			return nil, err
+		}
+		if n > last {
+			last = n
+		}
+	}
+	return newChangelog(last, st.Pruned), nil
+}
+
+/*
+recorder builds the events of the changes made by a request and releases
+its sequence numbers once they are written. done must be called after each
+write, even if it failed.
+*/
+type recorder struct {
+	wa    *WebApp
+	cl    *changelog
+	reqID string
+	seqs  []int64
+}
+
+// recorder for the changes of a request to ns, ctx is the one of the
+// request, the writes run with another context.
+func (wa *WebApp) recorder(ctx context.Context, ns string) *recorder {
+	return &recorder{wa: wa, cl: wa.changelog(ns), reqID: middleware.GetReqID(ctx)}
+}
+
+// event with the next sequence number
+func (r *recorder) event(ctx context.Context, typ, key string, size int64, checksum string) *Event {
+	e := newEvent(ctx, typ, "", key, size, checksum)
+	e.RequestID = r.reqID
+	if r.cl != nil {
+		e.Seq = r.cl.alloc()
+		r.seqs = append(r.seqs, e.Seq)
+	}
+	return e
+}
+
+// deletes is the deleteHook which records the deleted objects
+func (r *recorder) deletes(ctx context.Context, tx *sqlx.Tx, deleted []objectRef) error {
+	events := make([]*Event, 0, len(deleted))
+	for _, o := range deleted {
+		events = append(events, r.event(ctx, EventDeleted, o.Key, o.Size, o.Checksum))
+	}
+	return r.wa.record(ctx, tx, events...)
+}
+
+// done the writes finished, the changes are visible and sent to the stream
+func (r *recorder) done() {
+	if r.cl != nil {
+		r.cl.done(r.seqs...)
+	}
+	r.seqs = nil
+	r.wa.wakeRelay()
+	r.wa.wakeHooks()
+}
+
+// readChanges changes after since up to upto of all the files of ns
+func (wa *WebApp) readChanges(ctx context.Context, ns string, since, upto int64, limit int) ([]Event, error) {
+	changes := []Event{}
+	for _, db := range wa.nsDBs(ns) {
+		rows := []Event{}
+		err := db.SelectContext(ctx, &rows, `SELECT seq, type, data_id, size,
+			coalesce(checksum, '') AS checksum, coalesce(request_id, '') AS request_id, created_at
+			FROM changes WHERE seq > ? AND seq <= ? ORDER BY seq LIMIT ?`, since, upto, limit)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, rows...)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Seq < changes[j].Seq })
+	if len(changes) > limit {
+		changes = changes[:limit]
+	}
+	for i := range changes {
+		changes[i].Namespace = ns
+	}
+	return changes, nil
+}
+
+// ChangesResponse a page of the changelog, Last is the since of the next request
+type ChangesResponse struct {
+	Namespace string  `json:"namespace"`
+	Changes   []Event `json:"changes"`
+	Last      int64   `json:"last"`
+}
+
+/*
+GetChanges returns the changes of a namespace after ?since=, in order.
+With ?wait= (for example 30s) the request waits until there are changes.
+With ?stream=true or Accept: application/x-ndjson the changes are sent
+as lines of JSON while the client is connected. It fails with 410 if the
+changes after since were pruned, the consumer should sync again.
+*/
+func (wa *WebApp) GetChanges(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	if _, ok := wa.nsDB(ns); !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	cl := wa.changelog(ns)
+	if cl == nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": "changelog not available"})
+		return
+	}
+
+	q := r.URL.Query()
+	var since int64
+	var err error
+	if s := q.Get("since"); s != "" {
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil || since < 0 {
+			wa.render.JSON(w, http.StatusBadRequest,
+				map[string]string{"error": fmt.Sprintf("bad since %q", s)})
+			return
+		}
+	}
+	limit := changesLimit
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			wa.render.JSON(w, http.StatusBadRequest,
+				map[string]string{"error": fmt.Sprintf("bad limit %q", s)})
+			return
+		}
+		if limit > changesMaxLimit {
+			limit = changesMaxLimit
+		}
+	}
+	var wait time.Duration
+	if s := q.Get("wait"); s != "" {
+		if wait, err = time.ParseDuration(s); err != nil || wait < 0 {
+			wa.render.JSON(w, http.StatusBadRequest,
+				map[string]string{"error": fmt.Sprintf("bad wait %q", s)})
+			return
+		}
+		if wait > changesMaxWait {
+			wait = changesMaxWait
+		}
+	}
+	if pruned := cl.prunedSeq(); since < pruned {
+		wa.render.JSON(w, http.StatusGone,
+			map[string]string{"error": fmt.Sprintf("changes up to %d were pruned", pruned)})
+		return
+	}
+
+	if q.Get("stream") == "true" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+		wa.streamChanges(w, r, ns, cl, since, limit)
+		return
+	}
+
+	// a long poll returns what it has when the files are going to change
+	drain := wa.draining(ns)
+	var timeout <-chan time.Time
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	var changes []Event
+	for {
+		// taken before reading, so a commit in between isn't missed
+		changed := cl.changed()
+		changes, err = wa.readChanges(r.Context(), ns, since, cl.stable(), limit)
+		if err != nil {
+			wa.render.JSON(w, http.StatusInternalServerError,
+				map[string]string{"error": fmt.Sprintf("%s", err)})
+			return
+		}
+		if len(changes) > 0 || timeout == nil {
+			break
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			timeout = nil
+		case <-drain:
+			timeout = nil
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	last := since
+	if len(changes) > 0 {
+		last = changes[len(changes)-1].Seq
+	}
+	wa.render.JSON(w, http.StatusOK, &ChangesResponse{Namespace: ns, Changes: changes, Last: last})
+}
+
+// streamChanges sends the changes as NDJSON until the client goes away
+func (wa *WebApp) streamChanges(w http.ResponseWriter, r *http.Request, ns string, cl *changelog, since int64, limit int) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	// the client reconnects with the last seq when the files are changed
+	drain := wa.draining(ns)
+	for {
+		changed := cl.changed()
+		changes, err := wa.readChanges(r.Context(), ns, since, cl.stable(), limit)
+		if err != nil {
+			log.Printf("Error reading changes of %s: %s", ns, err)
+			return
+		}
+		for i := range changes {
+			if err := enc.Encode(&changes[i]); err != nil {
+				return
+			}
+			since = changes[i].Seq
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if len(changes) == limit {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-drain:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// pruneChanges removes the changes older than retention, base is the
+// main file of the namespace, which should be held open.
+func (wa *WebApp) pruneChanges(ctx context.Context, ns string, base *store.DB, retention time.Duration) error {
+	if base.ReadOnly {
+		return nil
+	}
+	cl := wa.changelog(ns)
+	if cl == nil {
+		return nil
+	}
+	cutoff := time.Now().UTC().Add(-retention).Format(time.RFC3339Nano)
+	var pruned int64
+	for _, db := range wa.nsDBs(ns) {
+		if db.ReadOnly {
+			continue
+		}
+		err := db.Write(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+			var n int64
+			err := tx.GetContext(ctx, &n, "SELECT coalesce(max(seq), 0) FROM changes WHERE created_at < ?", cutoff)
+			if err != nil || n == 0 {
+				return err
+			}
+			if n > pruned {
+				pruned = n
+			}
+			_, err = tx.ExecContext(ctx, "DELETE FROM changes WHERE created_at < ?", cutoff)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if pruned <= cl.prunedSeq() {
+		return nil
+	}
+	cl.mu.Lock()
+	cl.pruned = pruned
+	cl.mu.Unlock()
+	return base.Write(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		return putSetting(ctx, tx, "changelog", &changelogState{Pruned: pruned})
+	})
+}
+
+// pruneLoop removes periodically the old changes of the open namespaces
+func (wa *WebApp) pruneLoop(retention time.Duration) {
+	for range time.Tick(changesPruneInterval) {
+		for _, ns := range wa.openNames() {
+			h, base := wa.holdOpen(ns, false)
+			if h == nil {
+				continue
+			}
+			if err := wa.pruneChanges(context.Background(), ns, base, retention); err != nil {
+				log.Printf("Error pruning changes of %s: %s", ns, err)
+			}
+			wa.unhold(h, false)
+		}
+	}
+}
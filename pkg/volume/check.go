@@ -0,0 +1,307 @@
+package volume
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// checkPage objects verified by read transaction
+const checkPage = 500
+
+// quarantinePrefix the chunks of quarantined objects are moved under this prefix
+const quarantinePrefix = "_quarantine/"
+
+// BadObject an object which failed the check
+type BadObject struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// CheckReport result of checking a namespace
+type CheckReport struct {
+	Namespace string `json:"namespace"`
+	// Integrity rows returned by PRAGMA integrity_check, ["ok"] if the file is fine
+	Integrity   []string    `json:"integrity"`
+	Checked     int64       `json:"checked"`
+	Bad         []BadObject `json:"bad"`
+	Quarantined int64       `json:"quarantined"`
+	// Partitions reports of each open partition
+	Partitions []*CheckReport `json:"partitions,omitempty"`
+}
+
+// OK the file, its partitions and all its objects are fine
+func (c *CheckReport) OK() bool {
+	for _, p := range c.Partitions {
+		if !p.OK() {
+			return false
+		}
+	}
+	return len(c.Integrity) == 1 && c.Integrity[0] == "ok" && len(c.Bad) == 0
+}
+
+// CheckRequest options of a check
+type CheckRequest struct {
+	// Quarantine moves the bad objects out of the data table
+	Quarantine bool `json:"quarantine,omitempty"`
+}
+
+// verifyObject decompresses the content of an object and
+// compares it with its size and checksum.
+func verifyObject(ctx context.Context, tx *sqlx.Tx, m *DataModel) error {
+	var content io.Reader
+	if m.ChunkSize > 0 {
+		content = newChunkReader(ctx, tx, m.contentKey(), m.Size, m.ChunkSize)
+	} else {
+		zr, err := zlib.NewReader(bytes.NewReader(m.Data))
+		if err != nil {
+			return fmt.Errorf("zlib: %w", err)
+		}
+		content = zr
+	}
+	hash := sha256.New()
+	n, err := io.Copy(hash, content)
+	if err != nil {
+		return err
+	}
+	if n != m.Size {
+		return fmt.Errorf("size is %d, expected %d", n, m.Size)
+	}
+	if m.Checksum != "" && hex.EncodeToString(hash.Sum(nil)) != m.Checksum {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+// verifyPage verifies up to checkPage objects after the key last
+func verifyPage(ctx context.Context, db *store.DB, last string, rep *CheckReport) (string, int, error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryxContext(ctx, dataSelect+" WHERE data_id > ? ORDER BY data_id LIMIT ?", last, checkPage)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var m DataModel
+		if err := rows.StructScan(&m); err != nil {
+			return "", n, err
+		}
+		if err := verifyObject(ctx, tx, &m); err != nil {
+			rep.Bad = append(rep.Bad, BadObject{Key: m.DataID, Reason: err.Error()})
+		}
+		last = m.DataID
+		n++
+	}
+	return last, n, rows.Err()
+}
+
+// quarantineObjects moves the bad objects to the quarantine table. The content
+// of deduplicated objects is copied from the blob, its data and its chunks,
+// the blob is kept for the other objects which share it.
+func quarantineObjects(ctx context.Context, db *store.DB, bad []BadObject) (int64, error) {
+	var moved int64
+	err := db.Write(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		for _, b := range bad {
+			res, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO quarantine
+				(data_id, data, created_at, size, chunk_size, checksum, reason)
+				SELECT data_id, coalesce(b.data, d.data), created_at, size,
+					coalesce(b.chunk_size, d.chunk_size), checksum, ?
+				FROM data d LEFT JOIN blobs b ON d.dedup = 1 AND b.hash = d.checksum
+				WHERE data_id = ?`, b.Reason, b.Key)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				// deleted after it was checked
+				continue
+			}
+			stmts := []struct {
+				q    string
+				args []interface{}
+			}{
+				{"DELETE FROM chunks WHERE data_id = ?", []interface{}{quarantinePrefix + b.Key}},
+				{"UPDATE chunks SET data_id = ? WHERE data_id = ?", []interface{}{quarantinePrefix + b.Key, b.Key}},
+				{`INSERT INTO chunks (data_id, seq, data)
+					SELECT ?, c.seq, c.data FROM data d JOIN chunks c ON c.data_id = ? || d.checksum
+					WHERE d.data_id = ? AND d.dedup = 1`, []interface{}{quarantinePrefix + b.Key, blobPrefix, b.Key}},
+				{"DELETE FROM data WHERE data_id = ?", []interface{}{b.Key}},
+				{"DELETE FROM tags WHERE data_id = ?", []interface{}{b.Key}},
+			}
+			for _, s := range stmts {
+				if _, err := tx.ExecContext(ctx, s.q, s.args...); err != nil {
+					return err
+				}
+			}
+			moved++
+		}
+		return nil
+	})
+	return moved, err
+}
+
+// checkNS runs the integrity check of the file and verifies every object,
+// progress is called after each page of objects.
+func checkNS(ctx context.Context, ns string, db *store.DB, quarantine bool, progress func(*CheckReport)) (*CheckReport, error) {
+	rep := &CheckReport{Namespace: ns, Bad: []BadObject{}}
+	if err := db.SelectContext(ctx, &rep.Integrity, "PRAGMA integrity_check(100)"); err != nil {
+		return rep, err
+	}
+
+	last := ""
+	for {
+		next, n, err := verifyPage(ctx, db, last, rep)
+		rep.Checked += int64(n)
+		if err != nil {
+			return rep, err
+		}
+		if progress != nil {
+			progress(rep)
+		}
+		if n < checkPage {
+			break
+		}
+		last = next
+	}
+
+	if quarantine && len(rep.Bad) > 0 {
+		moved, err := quarantineObjects(ctx, db, rep.Bad)
+		rep.Quarantined = moved
+		if err != nil {
+			return rep, err
+		}
+	}
+	return rep, nil
+}
+
+/*
+checkFile opens and checks one file outside of a running volume. The file
+is opened read only, only with quarantine it's opened for writes and
+migrated, the quarantine table is added by a migration.
+*/
+func checkFile(ctx context.Context, path, label string, quarantine bool) (*CheckReport, error) {
+	opts := store.DefaultSQLiteOptions()
+	opts.ReadOnly = !quarantine
+	db, err := store.OpenDB(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if quarantine {
+		if err := migrate(db.W); err != nil {
+			return nil, err
+		}
+		return checkNS(ctx, label, db, quarantine, nil)
+	}
+	var version int
+	if err := db.GetContext(ctx, &version, "PRAGMA user_version"); err != nil {
+		return nil, err
+	}
+	if version < len(migrations) {
+		return nil, fmt.Errorf("%s has schema version %d, the volume migrates it to %d when it's opened",
+			label, version, len(migrations))
+	}
+	return checkNS(ctx, label, db, quarantine, nil)
+}
+
+// CheckFile checks the file of a namespace, and the files of its partitions,
+// outside of a running volume.
+func CheckFile(ctx context.Context, dir, ns string, quarantine bool) (*CheckReport, error) {
+	rep, err := checkFile(ctx, filepath.Join(dir, ns), ns, quarantine)
+	if err != nil {
+		return rep, err
+	}
+	parts, _ := filepath.Glob(filepath.Join(dir, ns, "*.db"))
+	for _, f := range parts {
+		name := strings.TrimSuffix(filepath.Base(f), ".db")
+		prep, err := checkFile(ctx, filepath.Join(dir, ns, name), ns+"/"+name, quarantine)
+		if err != nil {
+			return rep, err
+		}
+		rep.Partitions = append(rep.Partitions, prep)
+	}
+	return rep, nil
+}
+
+// Check verifies a namespace in background, the job result is the report
+func (wa *WebApp) Check(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	db, ok := wa.nsDB(ns)
+	if !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var req CheckRequest
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &req); err != nil {
+			wa.render.JSON(w, http.StatusBadRequest,
+				map[string]string{"error": fmt.Sprintf("%s", err)})
+			return
+		}
+	}
+	if req.Quarantine && db.ReadOnly {
+		wa.render.JSON(w, http.StatusLocked,
+			map[string]string{"error": "Namespace is read-only"})
+		return
+	}
+
+	job := wa.startNSJob("check", ns, func(ctx context.Context, j *Job) error {
+		var checked, bad, quarantined int64
+		run := func(db *store.DB) (*CheckReport, error) {
+			rep, err := checkNS(ctx, wa.fileLabel(ns, db), db, req.Quarantine, func(rep *CheckReport) {
+				j.Set("checked", checked+rep.Checked)
+				j.Set("bad", bad+int64(len(rep.Bad)))
+			})
+			checked += rep.Checked
+			bad += int64(len(rep.Bad))
+			quarantined += rep.Quarantined
+			j.Set("quarantined", quarantined)
+			return rep, err
+		}
+
+		main, err := run(db)
+		// the report is not modified after it's set as result
+		defer func() { j.SetResult(main) }()
+		if err != nil {
+			return err
+		}
+		for _, pdb := range wa.nsDBs(ns) {
+			if pdb == db {
+				continue
+			}
+			rep, err := run(pdb)
+			main.Partitions = append(main.Partitions, rep)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	wa.render.JSON(w, http.StatusAccepted, job)
+}
@@ -0,0 +1,248 @@
+package volume
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/jmoiron/sqlx"
+)
+
+// uploadPrefix temporary key of the chunks of the uploads in progress
+const uploadPrefix = "_upload/"
+
+/*
+Upload an object read from a write request.
+Objects up to the chunk size are compressed and kept in Data,
+bigger objects are split in chunks of ChunkSize bytes, each one
+compressed by its own, and written while the body is read
+under a temporary key. The chunks are moved to the final key
+in the same transaction which writes the object.
+Checksum is the sha256 of the data sent by the client.
+*/
+type Upload struct {
+	Data      []byte
+	Size      int64
+	ChunkSize int64
+	Checksum  string
+	tmpKey    string
+	// dedup the content is stored in the blob of Checksum
+	dedup bool
+	// replaces an older version in another partition
+	replaces bool
+	// others usage of the other files of the namespace
+	others *Usage
+}
+
+// compressChunk compresses up to n bytes from r, returns the
+// compressed data and how many bytes were read.
+func compressChunk(r io.Reader, n int64) ([]byte, int64, error) {
+	var zdata bytes.Buffer
+	zw := zlib.NewWriter(&zdata)
+	read, err := io.CopyN(zw, r, n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, read, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, read, err
+	}
+	return zdata.Bytes(), read, nil
+}
+
+// readUpload reads the body from r, if it's bigger than chunkSize
+// the chunks are written to db while they are read.
+func readUpload(ctx context.Context, db *store.DB, body io.Reader, chunkSize int64, others *Usage) (*Upload, error) {
+	up := &Upload{others: others}
+	hash := sha256.New()
+	defer func() {
+		up.Checksum = hex.EncodeToString(hash.Sum(nil))
+	}()
+	r := io.TeeReader(body, hash)
+	pending, n, err := compressChunk(r, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	up.Size = n
+	if n < chunkSize {
+		up.Data = pending
+		return up, nil
+	}
+
+	var seq int64
+	for {
+		next, n, err := compressChunk(r, chunkSize)
+		if err != nil {
+			up.discard(db)
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		if up.tmpKey == "" {
+			// unique across restarts, the chunks left by a crash are
+			// removed when the file is opened
+			up.tmpKey = fmt.Sprintf("%s%d-%s", uploadPrefix, time.Now().UnixNano(), randomHex(4))
+			up.ChunkSize = chunkSize
+		}
+		if err := writeChunk(ctx, db, up, seq, pending); err != nil {
+			up.discard(db)
+			return nil, err
+		}
+		seq++
+		up.Size += n
+		pending = next
+		if n < chunkSize {
+			break
+		}
+	}
+	if up.tmpKey == "" {
+		// the body has exactly chunkSize bytes
+		up.Data = pending
+		return up, nil
+	}
+	if err := writeChunk(ctx, db, up, seq, pending); err != nil {
+		up.discard(db)
+		return nil, err
+	}
+	// data is NOT NULL, chunked objects keep an empty blob
+	up.Data = []byte{}
+	return up, nil
+}
+
+func writeChunk(ctx context.Context, db *store.DB, up *Upload, seq int64, data []byte) error {
+	return db.Write(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		if err := checkBytes(ctx, tx, int64(len(data)), up.others); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO chunks (data_id, seq, data) VALUES ($1, $2, $3)", up.tmpKey, seq, data)
+		return err
+	})
+}
+
+// discard removes the chunks written if the upload fails
+func (up *Upload) discard(db *store.DB) {
+	if up.tmpKey == "" {
+		return
+	}
+	db.Write(context.Background(), func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM chunks WHERE data_id = ?", up.tmpKey)
+		return err
+	})
+}
+
+// discardUploads removes the chunks of the uploads which didn't finish,
+// the usage is updated by the triggers. It should be called when a file
+// is opened, before any upload could be using it.
+func discardUploads(db *sqlx.DB) (int64, error) {
+	// a range and not LIKE, _ is a wildcard there; '0' follows '/'
+	res, err := db.Exec("DELETE FROM chunks WHERE data_id >= ? AND data_id < ?",
+		uploadPrefix, "_upload0")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// stored bytes of the upload which are still not counted in the usage
+func (up *Upload) stored() int64 {
+	return int64(len(up.Data))
+}
+
+// commitChunks replaces the chunks of key with the chunks of the upload,
+// it should be called in the transaction which writes the object.
+func (up *Upload) commitChunks(ctx context.Context, tx *sqlx.Tx, key string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chunks WHERE data_id = ?", key); err != nil {
+		return err
+	}
+	if up.tmpKey == "" {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "UPDATE chunks SET data_id = ? WHERE data_id = ?", key, up.tmpKey)
+	return err
+}
+
+/*
+chunkReader io.ReadSeeker over a chunked object, only the chunk
+being read is kept in memory. It should be used inside a read
+transaction so all the chunks belong to the same version of the object.
+*/
+type chunkReader struct {
+	ctx       context.Context
+	tx        *sqlx.Tx
+	key       string
+	size      int64
+	chunkSize int64
+	pos       int64
+	seq       int64
+	cur       []byte
+}
+
+func newChunkReader(ctx context.Context, tx *sqlx.Tx, key string, size, chunkSize int64) *chunkReader {
+	return &chunkReader{ctx: ctx, tx: tx, key: key, size: size, chunkSize: chunkSize, seq: -1}
+}
+
+func (c *chunkReader) load(seq int64) error {
+	var blob []byte
+	err := c.tx.GetContext(c.ctx, &blob,
+		"SELECT data FROM chunks WHERE data_id = ? AND seq = ?", c.key, seq)
+	if err != nil {
+		return fmt.Errorf("chunk %d of %s: %w", seq, c.key, err)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	c.cur, err = ioutil.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+	c.seq = seq
+	return nil
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.pos >= c.size {
+		return 0, io.EOF
+	}
+	seq := c.pos / c.chunkSize
+	if seq != c.seq {
+		if err := c.load(seq); err != nil {
+			return 0, err
+		}
+	}
+	off := c.pos - seq*c.chunkSize
+	if off >= int64(len(c.cur)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, c.cur[off:])
+	c.pos += int64(n)
+	return n, nil
+}
+
+func (c *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = c.pos + offset
+	case io.SeekEnd:
+		pos = c.size + offset
+	default:
+		return 0, errors.New("chunkReader.Seek: invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("chunkReader.Seek: negative position")
+	}
+	c.pos = pos
+	return pos, nil
+}
@@ -0,0 +1,98 @@
+package volume
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/go-chi/chi/v5"
+)
+
+// Compaction modes
+const (
+	CompactFull        = "full"
+	CompactIncremental = "incremental"
+)
+
+/*
+CompactRequest how a namespace is compacted. A full compaction
+rebuilds the file with VACUUM, it needs free space for a copy of the
+file and the writes wait until it finishes. An incremental compaction
+only releases the free pages, and requires auto_vacuum INCREMENTAL.
+*/
+type CompactRequest struct {
+	Mode string `json:"mode,omitempty"`
+}
+
+// diskSize bytes used by the file of a namespace and its WAL
+func diskSize(path string) int64 {
+	return fileSize(path) + fileSize(path+"-wal")
+}
+
+// compactNS compacts a file of the namespace and adds the space
+// reclaimed to the counters of the job.
+func compactNS(ctx context.Context, db *store.DB, mode string, j *Job) error {
+	before := diskSize(db.Path)
+	j.Add("sizeBefore", before)
+	var free int64
+	if err := db.GetContext(ctx, &free, "PRAGMA freelist_count"); err == nil {
+		j.Add("freePages", free)
+	}
+
+	var err error
+	if mode == CompactIncremental {
+		err = db.IncrementalVacuum(ctx, 0)
+	} else {
+		err = db.Vacuum(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	after := diskSize(db.Path)
+	j.Add("sizeAfter", after)
+	j.Add("reclaimed", before-after)
+	return nil
+}
+
+// Compact starts the compaction of a namespace and its partitions in background
+func (wa *WebApp) Compact(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	if _, ok := wa.nsDB(ns); !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	req := CompactRequest{Mode: CompactFull}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &req); err != nil {
+			wa.render.JSON(w, http.StatusBadRequest,
+				map[string]string{"error": fmt.Sprintf("%s", err)})
+			return
+		}
+	}
+	if req.Mode != CompactFull && req.Mode != CompactIncremental {
+		wa.render.JSON(w, http.StatusBadRequest,
+			map[string]string{"error": fmt.Sprintf("bad mode %q", req.Mode)})
+		return
+	}
+
+	job := wa.startNSJob("compact", ns, func(ctx context.Context, j *Job) error {
+		for _, db := range wa.nsDBs(ns) {
+			if err := compactNS(ctx, db, req.Mode, j); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	wa.render.JSON(w, http.StatusAccepted, job)
+}
@@ -0,0 +1,82 @@
+package volume
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// blobPrefix the chunks of a shared blob are stored under this prefix
+// followed by its hash.
+const blobPrefix = "_blob/"
+
+// contentKey key of the chunks of an object
+func (d *DataModel) contentKey() string {
+	if d.Dedup {
+		return blobPrefix + d.Checksum
+	}
+	return d.DataID
+}
+
+// dataSelect selects the columns mapped by DataModel, the content of
+// deduplicated objects is taken from its blob.
+const dataSelect = `SELECT data_id, coalesce(b.data, d.data) AS data, created_at, updated_at, size,
+	coalesce(b.chunk_size, d.chunk_size) AS chunk_size, coalesce(checksum, '') AS checksum, dedup
+	FROM data d LEFT JOIN blobs b ON d.dedup = 1 AND b.hash = d.checksum`
+
+/*
+prepareObject checks the quota and returns the upload which should be
+written in the data table. When the namespace has dedup enabled the
+content is stored in the blobs table, only once by checksum, and the
+object only keeps a reference to it. The references are counted by triggers.
+*/
+func prepareObject(ctx context.Context, tx *sqlx.Tx, key string, up *Upload) (*Upload, error) {
+	opts, err := getOptions(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Dedup || up.Checksum == "" {
+		return up, checkQuota(ctx, tx, key, up.stored(), up.others)
+	}
+
+	var refs int64
+	err = tx.GetContext(ctx, &refs, "SELECT refs FROM blobs WHERE hash = ?", up.Checksum)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	exists := err == nil
+
+	var stored int64
+	if !exists {
+		stored = up.stored()
+	}
+	if err := checkQuota(ctx, tx, key, stored, up.others); err != nil {
+		return nil, err
+	}
+
+	if exists {
+		// the chunks already written are not needed
+		if up.tmpKey != "" {
+			_, err = tx.ExecContext(ctx, "DELETE FROM chunks WHERE data_id = ?", up.tmpKey)
+		}
+	} else {
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO blobs (hash, data, chunk_size) VALUES ($1, $2, $3)",
+			up.Checksum, up.Data, up.ChunkSize)
+		if err == nil && up.tmpKey != "" {
+			_, err = tx.ExecContext(ctx, "UPDATE chunks SET data_id = ? WHERE data_id = ?",
+				blobPrefix+up.Checksum, up.tmpKey)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Upload{
+		Data:     []byte{},
+		Size:     up.Size,
+		Checksum: up.Checksum,
+		dedup:    true,
+	}, nil
+}
@@ -0,0 +1,191 @@
+package volume
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// deleteChunk how many objects are deleted by transaction in a bulk delete
+const deleteChunk = 500
+
+/*
+DeleteSelector which objects should be deleted by a bulk delete.
+At least one condition is required, the conditions are combined with AND.
+*/
+type DeleteSelector struct {
+	Prefix string `json:"prefix,omitempty"`
+	Since  string `json:"since,omitempty"`
+	Until  string `json:"until,omitempty"`
+	Tags   Tags   `json:"tags,omitempty"`
+	DryRun bool   `json:"dryRun,omitempty"`
+}
+
+// filter converts the selector to the filter used by the list endpoints
+func (s *DeleteSelector) filter() (*listFilter, error) {
+	if s.Prefix == "" && s.Since == "" && s.Until == "" && len(s.Tags) == 0 {
+		return nil, errors.New("at least one of prefix, since, until or tags is required")
+	}
+	f := &listFilter{Prefix: s.Prefix, Tags: Tags{}}
+	for k, v := range s.Tags {
+		f.Tags[k] = v
+	}
+	var err error
+	if s.Since != "" {
+		if f.Since, err = parseTime(s.Since); err != nil {
+			return nil, err
+		}
+	}
+	if s.Until != "" {
+		if f.Until, err = parseTime(s.Until); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// DeleteResponse result of a dry run
+type DeleteResponse struct {
+	Namespace string `json:"namespace"`
+	DryRun    bool   `json:"dryRun"`
+	Matched   int64  `json:"matched"`
+}
+
+// deleteHook is called in the transaction of a delete with the objects deleted
+type deleteHook func(ctx context.Context, tx *sqlx.Tx, deleted []objectRef) error
+
+// deleteKeys deletes objects and its tags in one transaction,
+// it returns the objects which existed. hook could be nil.
+func deleteKeys(ctx context.Context, db *store.DB, hook deleteHook, keys ...string) ([]objectRef, error) {
+	var deleted []objectRef
+	err := db.Write(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		q, args, err := sqlx.In("SELECT data_id, size, coalesce(checksum, '') AS checksum FROM data WHERE data_id IN (?)", keys)
+		if err != nil {
+			return err
+		}
+		deleted = nil
+		if err := tx.SelectContext(ctx, &deleted, q, args...); err != nil {
+			return err
+		}
+		q, args, err = sqlx.In("DELETE FROM data WHERE data_id IN (?)", keys)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, q, args...); err != nil {
+			return err
+		}
+
+		for _, table := range []string{"tags", "chunks"} {
+			q, args, err = sqlx.In("DELETE FROM "+table+" WHERE data_id IN (?)", keys)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, q, args...); err != nil {
+				return err
+			}
+		}
+		if hook != nil {
+			return hook(ctx, tx, deleted)
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// bulkDelete deletes in chunks the objects matched by the filter,
+// the changes of each chunk are released when it's written.
+func bulkDelete(ctx context.Context, db *store.DB, f *listFilter, j *Job, rec *recorder) error {
+	where, args := f.where()
+	for {
+		keys := []string{}
+		err := db.SelectContext(ctx, &keys, "SELECT data_id FROM data"+where+" LIMIT ?",
+			append(args, deleteChunk)...)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		deleted, err := deleteKeys(ctx, db, rec.deletes, keys...)
+		rec.done()
+		if err != nil {
+			return err
+		}
+		j.Add("deleted", int64(len(deleted)))
+	}
+}
+
+// BulkDelete deletes objects by prefix, creation date range or tags.
+// The delete is executed in background and a job is returned,
+// with dryRun only the count of matched objects is returned.
+func (wa *WebApp) BulkDelete(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	if _, ok := wa.nsDB(ns); !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var sel DeleteSelector
+	err = json.Unmarshal(b, &sel)
+	if err != nil {
+		wa.render.JSON(w, http.StatusBadRequest,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	f, err := sel.filter()
+	if err != nil {
+		wa.render.JSON(w, http.StatusBadRequest,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+
+	where, args := f.where()
+	var matched int64
+	for _, db := range wa.nsDBs(ns) {
+		var n int64
+		err = db.GetContext(r.Context(), &n, "SELECT count(*) FROM data"+where, args...)
+		if err != nil {
+			wa.render.JSON(w, http.StatusInternalServerError,
+				map[string]string{"error": fmt.Sprintf("%s", err)})
+			return
+		}
+		matched += n
+	}
+
+	if sel.DryRun {
+		wa.render.JSON(w, http.StatusOK, &DeleteResponse{
+			Namespace: ns,
+			DryRun:    true,
+			Matched:   matched,
+		})
+		return
+	}
+
+	// the events of the job have the id of the request
+	rec := wa.recorder(r.Context(), ns)
+	job := wa.startNSJob("delete", ns, func(ctx context.Context, j *Job) error {
+		j.Set("matched", matched)
+		// the files are taken once the job holds the namespace,
+		// partitions could be dropped before
+		for _, db := range wa.nsDBs(ns) {
+			if err := bulkDelete(ctx, db, f, j, rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	wa.render.JSON(w, http.StatusAccepted, job)
+}
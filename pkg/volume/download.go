@@ -0,0 +1,96 @@
+package volume
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/go-chi/chi/v5"
+)
+
+// snapshotPrefix temporary files of the downloads, they don't end in .db
+// so they aren't taken as namespaces.
+const snapshotPrefix = "_snapshot-"
+
+/*
+Download streams a consistent snapshot of the file of a namespace, or of
+one of its partitions with ?partition= or /files/{ns}/{part}.db. The snapshot
+is written to a temporary file in NSDir with the backup API, so the live file
+is never sent while it's being written. With ?compress=gzip it's compressed
+on the fly.
+*/
+func (wa *WebApp) Download(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	db, ok := wa.nsDB(ns)
+	if !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	name := ns
+	part := chi.URLParam(r, "part")
+	if part == "" {
+		part = r.URL.Query().Get("partition")
+	}
+	if part != "" {
+		p, _ := wa.nsParts(ns)
+		var pdb *store.DB
+		if p != nil {
+			p.mu.RLock()
+			pdb = p.dbs[part]
+			p.mu.RUnlock()
+		}
+		if pdb == nil {
+			wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Partition not found"})
+			return
+		}
+		db, name = pdb, ns+"-"+part
+	}
+	compress := r.URL.Query().Get("compress")
+	if compress != "" && compress != "gzip" {
+		wa.render.JSON(w, http.StatusBadRequest,
+			map[string]string{"error": fmt.Sprintf("bad compress %q", compress)})
+		return
+	}
+
+	f, err := os.CreateTemp(wa.cfg.NSDir, snapshotPrefix+"*.tmp")
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := db.Snapshot(r.Context(), f.Name()); err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+
+	filename := name + ".db"
+	if compress == "gzip" {
+		filename += ".gz"
+		w.Header().Set("Content-Type", "application/gzip")
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.sqlite3")
+		if fi, err := f.Stat(); err == nil {
+			w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		}
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	var dst io.Writer = w
+	if compress == "gzip" {
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		dst = gz
+	}
+	io.Copy(dst, f)
+}
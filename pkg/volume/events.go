@@ -0,0 +1,69 @@
+package volume
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Event types sent to the stream
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+	// EventExpired reserved for objects removed by a retention policy
+	EventExpired = "expired"
+)
+
+// Event a change of an object. Size and checksum are the ones of the new
+// version, or of the removed version for deletes. Seq is its position
+// in the changelog of the namespace.
+type Event struct {
+	Seq       int64  `json:"seq,omitempty" db:"seq"`
+	Type      string `json:"type" db:"type"`
+	Namespace string `json:"namespace" db:"-"`
+	Key       string `json:"path" db:"data_id"`
+	Size      int64  `json:"size" db:"size"`
+	Checksum  string `json:"checksum,omitempty" db:"checksum"`
+	Timestamp string `json:"timestamp" db:"created_at"`
+	RequestID string `json:"requestID,omitempty" db:"request_id"`
+}
+
+// objectRef an object removed, used for the delete events
+type objectRef struct {
+	Key      string `db:"data_id"`
+	Size     int64  `db:"size"`
+	Checksum string `db:"checksum"`
+}
+
+// newEvent the request id is taken from ctx
+func newEvent(ctx context.Context, typ, ns, key string, size int64, checksum string) *Event {
+	return &Event{
+		Type:      typ,
+		Namespace: ns,
+		Key:       key,
+		Size:      size,
+		Checksum:  checksum,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		RequestID: middleware.GetReqID(ctx),
+	}
+}
+
+// values fields of the stream message, namespace and path are kept
+// for the consumers written before the event types.
+func (e *Event) values() map[string]interface{} {
+	v := map[string]interface{}{
+		"type":       e.Type,
+		"namespace":  e.Namespace,
+		"path":       e.Key,
+		"size":       e.Size,
+		"checksum":   e.Checksum,
+		"timestamp":  e.Timestamp,
+		"request_id": e.RequestID,
+	}
+	if e.Seq > 0 {
+		v["seq"] = e.Seq
+	}
+	return v
+}
@@ -1,9 +1,14 @@
 package volume
 
 import (
+	"context"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
 
+	"github.com/algorinfo/rawstore/pkg/store"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -27,3 +32,87 @@ func FileServer(r chi.Router, path string, root http.FileSystem) {
 		fs.ServeHTTP(w, r)
 	})
 }
+
+/*
+nsFiles the files of NSDir served under /files. The sqlite side files and
+the uploads and downloads in progress are not served nor listed. The files
+of the namespaces are routed to Download, other .db files, like the archived
+partitions, are sent as a snapshot taken with the backup API too.
+*/
+type nsFiles struct {
+	cfg *Config
+}
+
+// hiddenFile the file is written by sqlite or by a request in progress
+func hiddenFile(name string) bool {
+	base := path.Base(name)
+	for _, suffix := range []string{"-wal", "-shm", "-journal", ".tmp"} {
+		if strings.HasSuffix(base, suffix) {
+			return true
+		}
+	}
+	return strings.HasPrefix(base, snapshotPrefix) ||
+		strings.HasPrefix(path.Clean("/"+name), "/"+uploadDir)
+}
+
+func (fs nsFiles) Open(name string) (http.File, error) {
+	if hiddenFile(name) {
+		return nil, os.ErrNotExist
+	}
+	if !strings.HasSuffix(name, ".db") {
+		f, err := http.Dir(fs.cfg.NSDir).Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return listedFile{f}, nil
+	}
+
+	full := filepath.Join(fs.cfg.NSDir, filepath.FromSlash(path.Clean("/"+name)))
+	if _, err := os.Stat(full); err != nil {
+		return nil, err
+	}
+	opts := *fs.cfg.sqliteOptions()
+	opts.ReadOnly = true
+	db, err := store.OpenDB(strings.TrimSuffix(full, ".db"), &opts)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	f, err := os.CreateTemp(fs.cfg.NSDir, snapshotPrefix+"*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Snapshot(context.Background(), f.Name()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return snapshotFile{f}, nil
+}
+
+// listedFile hides the side files in the listings of the dirs
+type listedFile struct {
+	http.File
+}
+
+func (f listedFile) Readdir(count int) ([]os.FileInfo, error) {
+	files, err := f.File.Readdir(count)
+	res := files[:0]
+	for _, fi := range files {
+		if !hiddenFile(fi.Name()) && fi.Name() != uploadDir {
+			res = append(res, fi)
+		}
+	}
+	return res, err
+}
+
+// snapshotFile a temporary snapshot removed once it's sent
+type snapshotFile struct {
+	*os.File
+}
+
+func (f snapshotFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
@@ -0,0 +1,547 @@
+package volume
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// EventTest type of the event sent by the test delivery of a hook
+const EventTest = "test"
+
+const (
+	// hookBatch max changes delivered to a hook in each pass
+	hookBatch = 50
+	// hookWorkers hooks delivered at the same time, so a slow endpoint
+	// doesn't delay the other hooks
+	hookWorkers = 8
+)
+
+var (
+	// hookMaxAttempts a change which fails this many times is moved
+	// to the dead letters of the hook and the next one is delivered
+	hookMaxAttempts = 8
+	// hookClient used for the deliveries
+	hookClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+/*
+Hook a webhook of a namespace. The changes are delivered in order as a POST
+with the change as JSON, signed with the secret in X-RD-Signature
+(sha256=hex of the HMAC-SHA256 of the body). Cursor is the seq of the last
+change delivered or given up.
+*/
+type Hook struct {
+	ID        string   `json:"id" db:"id"`
+	URL       string   `json:"url" db:"url"`
+	Secret    string   `json:"secret,omitempty" db:"secret"`
+	Prefix    string   `json:"prefix,omitempty" db:"prefix"`
+	Events    []string `json:"events,omitempty" db:"-"`
+	EventList string   `json:"-" db:"events"`
+	Cursor    int64    `json:"cursor" db:"cursor"`
+	Attempts  int      `json:"attempts" db:"attempts"`
+	NextAt    string   `json:"nextAt,omitempty" db:"next_at"`
+	LastError string   `json:"lastError,omitempty" db:"last_error"`
+	CreatedAt string   `json:"createdAt" db:"created_at"`
+}
+
+// DeadLetter a change which couldn't be delivered to a hook
+type DeadLetter struct {
+	ID        int64           `json:"id" db:"id"`
+	HookID    string          `json:"hookId" db:"hook_id"`
+	Seq       int64           `json:"seq" db:"seq"`
+	Event     json.RawMessage `json:"event" db:"event"`
+	Attempts  int             `json:"attempts" db:"attempts"`
+	LastError string          `json:"lastError,omitempty" db:"last_error"`
+	FailedAt  string          `json:"failedAt" db:"failed_at"`
+}
+
+const hookSelect = `SELECT id, url, secret, prefix, events, cursor, attempts,
+	coalesce(next_at, '') AS next_at, coalesce(last_error, '') AS last_error,
+	coalesce(created_at, '') AS created_at FROM hooks`
+
+func (h *Hook) validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("bad url %q", h.URL)
+	}
+	for _, typ := range h.Events {
+		switch typ {
+		case EventCreated, EventUpdated, EventDeleted, EventExpired:
+		default:
+			return fmt.Errorf("bad event type %q", typ)
+		}
+	}
+	return nil
+}
+
+// matches the hook wants the event
+func (h *Hook) matches(e *Event) bool {
+	if !strings.HasPrefix(e.Key, h.Prefix) {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, typ := range h.Events {
+		if typ == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// randomHex n random bytes as hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sign value of X-RD-Signature for a body
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts an event to a hook, any status but 2xx is an error
+func deliver(ctx context.Context, h *Hook, e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "rawdata-hooks")
+	req.Header.Set("X-RD-Event", e.Type)
+	req.Header.Set("X-RD-Delivery", fmt.Sprintf("%s-%d", h.ID, e.Seq))
+	req.Header.Set("X-RD-Signature", sign(h.Secret, body))
+	rsp, err := hookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(rsp.Body, 64<<10))
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("status %d", rsp.StatusCode)
+	}
+	return nil
+}
+
+func getHooks(ctx context.Context, db sqlx.QueryerContext, where string, args ...interface{}) ([]Hook, error) {
+	hooks := []Hook{}
+	if err := sqlx.SelectContext(ctx, db, &hooks, hookSelect+where+" ORDER BY created_at, id", args...); err != nil {
+		return nil, err
+	}
+	for i := range hooks {
+		if hooks[i].EventList != "" {
+			hooks[i].Events = strings.Split(hooks[i].EventList, ",")
+		}
+	}
+	return hooks, nil
+}
+
+func getHook(ctx context.Context, db sqlx.QueryerContext, id string) (*Hook, error) {
+	hooks, err := getHooks(ctx, db, " WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(hooks) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &hooks[0], nil
+}
+
+/*
+runHook delivers the changes after the cursor of a hook up to upto. A failed
+delivery is retried with backoff, blocking the next changes, until it fails
+hookMaxAttempts times and it's moved to the dead letters.
+*/
+func (wa *WebApp) runHook(ctx context.Context, ns string, base *store.DB, cl *changelog, h *Hook, upto int64) error {
+	if pruned := cl.prunedSeq(); h.Cursor < pruned {
+		log.Printf("Hook %s of %s missed the changes up to %d, they were pruned", h.ID, ns, pruned)
+		h.Cursor = pruned
+	}
+	changes, err := wa.readChanges(ctx, ns, h.Cursor, upto, hookBatch)
+	if err != nil {
+		return err
+	}
+	dead := []DeadLetter{}
+	for i := range changes {
+		e := &changes[i]
+		if !h.matches(e) {
+			h.Cursor = e.Seq
+			continue
+		}
+		err := deliver(ctx, h, e)
+		if err == nil {
+			h.Cursor, h.Attempts, h.NextAt = e.Seq, 0, ""
+			continue
+		}
+		h.Attempts++
+		h.LastError = err.Error()
+		if h.Attempts < hookMaxAttempts {
+			h.NextAt = time.Now().UTC().Add(backoff(h.Attempts)).Format(sqliteTime)
+			break
+		}
+		b, _ := json.Marshal(e)
+		dead = append(dead, DeadLetter{HookID: h.ID, Seq: e.Seq, Event: b, Attempts: h.Attempts, LastError: h.LastError})
+		h.Cursor, h.Attempts, h.NextAt = e.Seq, 0, ""
+	}
+
+	return base.Write(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE hooks SET cursor = ?, attempts = ?, next_at = nullif(?, ''),
+			last_error = nullif(?, '') WHERE id = ?`, h.Cursor, h.Attempts, h.NextAt, h.LastError, h.ID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// removed while delivering
+			return nil
+		}
+		for _, d := range dead {
+			_, err := tx.ExecContext(ctx, `INSERT INTO hook_dead (hook_id, seq, event, attempts, last_error)
+				VALUES (?, ?, ?, ?, ?)`, d.HookID, d.Seq, string(d.Event), d.Attempts, d.LastError)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// runHooks delivers the pending changes of the hooks of a namespace
+// which are not waiting for a retry, base is its main file. Each hook is
+// delivered in its own goroutine once it gets a slot of workers, and it
+// returns when all of them finished.
+func (wa *WebApp) runHooks(ctx context.Context, ns string, base *store.DB, workers chan struct{}) error {
+	if base.ReadOnly {
+		return nil
+	}
+	hooks, err := getHooks(ctx, base, " WHERE next_at IS NULL OR next_at <= ?",
+		time.Now().UTC().Format(sqliteTime))
+	if err != nil || len(hooks) == 0 {
+		return err
+	}
+	cl := wa.changelog(ns)
+	if cl == nil {
+		return nil
+	}
+	upto := cl.stable()
+	var wg sync.WaitGroup
+	for i := range hooks {
+		if hooks[i].Cursor >= upto {
+			continue
+		}
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(h *Hook) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			if err := wa.runHook(ctx, ns, base, cl, h, upto); err != nil {
+				log.Printf("Error running hook %s of %s: %s", h.ID, ns, err)
+			}
+		}(&hooks[i])
+	}
+	wg.Wait()
+	return nil
+}
+
+// startHooks starts the hook loop, once
+func (wa *WebApp) startHooks() {
+	wa.hooksOnce.Do(func() {
+		atomic.StoreInt32(&wa.hooksOn, 1)
+		go wa.hookLoop()
+	})
+}
+
+// checkHooks starts the hook loop if the namespace of db has hooks
+func (wa *WebApp) checkHooks(db *store.DB) {
+	var found bool
+	if err := db.Get(&found, "SELECT EXISTS (SELECT 1 FROM hooks)"); err == nil && found {
+		wa.startHooks()
+	}
+}
+
+// wakeHooks tells the hook loop that there are new changes
+func (wa *WebApp) wakeHooks() {
+	if atomic.LoadInt32(&wa.hooksOn) == 0 {
+		return
+	}
+	select {
+	case wa.hookWake <- struct{}{}:
+	default:
+	}
+}
+
+// hookLoop delivers the changes of the open namespaces to its hooks,
+// the closed ones are delivered the next time they are opened. Each
+// namespace runs in its own goroutine, up to hookWorkers deliveries at the
+// same time, and one still running is skipped until it finishes.
+func (wa *WebApp) hookLoop() {
+	tick := time.NewTicker(relayInterval)
+	defer tick.Stop()
+	workers := make(chan struct{}, hookWorkers)
+	running := map[string]bool{}
+	done := make(chan string)
+	for {
+		select {
+		case <-tick.C:
+		case <-wa.hookWake:
+		case ns := <-done:
+			delete(running, ns)
+			continue
+		}
+		for _, ns := range wa.openNames() {
+			if running[ns] {
+				continue
+			}
+			h, base := wa.holdOpen(ns, false)
+			if h == nil {
+				continue
+			}
+			running[ns] = true
+			go func(ns string) {
+				defer func() { done <- ns }()
+				defer wa.unhold(h, false)
+				if err := wa.runHooks(context.Background(), ns, base, workers); err != nil {
+					log.Printf("Error running hooks of %s: %s", ns, err)
+				}
+			}(ns)
+		}
+	}
+}
+
+// CreateHook registers a webhook, the changes made after it are delivered.
+// The secret is generated if it's not sent, and it's only returned here.
+func (wa *WebApp) CreateHook(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	db, ok := wa.nsDB(ns)
+	if !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var h Hook
+	if err := json.Unmarshal(b, &h); err != nil {
+		wa.render.JSON(w, http.StatusBadRequest,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	if err := h.validate(); err != nil {
+		wa.render.JSON(w, http.StatusBadRequest,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	h.ID = randomHex(8)
+	if h.Secret == "" {
+		h.Secret = randomHex(32)
+	}
+	if cl := wa.changelog(ns); cl != nil {
+		h.Cursor = cl.stable()
+	}
+	h.CreatedAt = time.Now().UTC().Format(sqliteTime)
+	h.Attempts, h.NextAt, h.LastError = 0, "", ""
+	err = db.Write(r.Context(), func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO hooks (id, url, secret, prefix, events, cursor, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, h.ID, h.URL, h.Secret, h.Prefix, strings.Join(h.Events, ","), h.Cursor, h.CreatedAt)
+		return err
+	})
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	wa.startHooks()
+	wa.render.JSON(w, http.StatusCreated, &h)
+}
+
+// AllHooks webhooks of a namespace, without its secret
+func (wa *WebApp) AllHooks(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	db, ok := wa.nsDB(ns)
+	if !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	hooks, err := getHooks(r.Context(), db, "")
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	wa.render.JSON(w, http.StatusOK, hooks)
+}
+
+// hookFromRequest the hook in the url, it renders the error if it's not found
+func (wa *WebApp) hookFromRequest(w http.ResponseWriter, r *http.Request) (*store.DB, *Hook, bool) {
+	ns := chi.URLParam(r, "ns")
+	db, ok := wa.nsDB(ns)
+	if !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return nil, nil, false
+	}
+	h, err := getHook(r.Context(), db, chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Hook not found"})
+		return nil, nil, false
+	}
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return nil, nil, false
+	}
+	return db, h, true
+}
+
+// GetHook a webhook of a namespace, without its secret
+func (wa *WebApp) GetHook(w http.ResponseWriter, r *http.Request) {
+	_, h, ok := wa.hookFromRequest(w, r)
+	if !ok {
+		return
+	}
+	h.Secret = ""
+	wa.render.JSON(w, http.StatusOK, h)
+}
+
+// DelHook removes a webhook and its dead letters
+func (wa *WebApp) DelHook(w http.ResponseWriter, r *http.Request) {
+	db, h, ok := wa.hookFromRequest(w, r)
+	if !ok {
+		return
+	}
+	err := db.Write(r.Context(), func(ctx context.Context, tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM hook_dead WHERE hook_id = ?", h.ID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "DELETE FROM hooks WHERE id = ?", h.ID)
+		return err
+	})
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	wa.render.JSON(w, http.StatusOK, map[string]string{"msg": "ok"})
+}
+
+// DeliveryResponse result of a test delivery or of a retry of the dead letters
+type DeliveryResponse struct {
+	Delivered int    `json:"delivered"`
+	Failed    int    `json:"failed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// TestHook sends a test event to a webhook and returns the result
+func (wa *WebApp) TestHook(w http.ResponseWriter, r *http.Request) {
+	_, h, ok := wa.hookFromRequest(w, r)
+	if !ok {
+		return
+	}
+	e := newEvent(r.Context(), EventTest, chi.URLParam(r, "ns"), "", 0, "")
+	rsp := &DeliveryResponse{}
+	if err := deliver(r.Context(), h, e); err != nil {
+		rsp.Failed, rsp.Error = 1, err.Error()
+	} else {
+		rsp.Delivered = 1
+	}
+	wa.render.JSON(w, http.StatusOK, rsp)
+}
+
+// DeadLetters changes which couldn't be delivered to a webhook
+func (wa *WebApp) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	db, h, ok := wa.hookFromRequest(w, r)
+	if !ok {
+		return
+	}
+	dead := []DeadLetter{}
+	err := db.SelectContext(r.Context(), &dead, `SELECT id, hook_id, seq, CAST(event AS BLOB) AS event, attempts,
+		coalesce(last_error, '') AS last_error, failed_at FROM hook_dead WHERE hook_id = ? ORDER BY id`, h.ID)
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	wa.render.JSON(w, http.StatusOK, dead)
+}
+
+// RetryDeadLetters delivers again the dead letters of a webhook,
+// the ones delivered are removed.
+func (wa *WebApp) RetryDeadLetters(w http.ResponseWriter, r *http.Request) {
+	db, h, ok := wa.hookFromRequest(w, r)
+	if !ok {
+		return
+	}
+	dead := []DeadLetter{}
+	err := db.SelectContext(r.Context(), &dead,
+		"SELECT id, seq, CAST(event AS BLOB) AS event FROM hook_dead WHERE hook_id = ? ORDER BY id", h.ID)
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	rsp := &DeliveryResponse{}
+	delivered := []int64{}
+	for _, d := range dead {
+		var e Event
+		err := json.Unmarshal(d.Event, &e)
+		if err == nil {
+			err = deliver(r.Context(), h, &e)
+		}
+		if err != nil {
+			rsp.Failed++
+			rsp.Error = err.Error()
+			continue
+		}
+		rsp.Delivered++
+		delivered = append(delivered, d.ID)
+	}
+	if len(delivered) > 0 {
+		err = db.Write(r.Context(), func(ctx context.Context, tx *sqlx.Tx) error {
+			q, args, err := sqlx.In("DELETE FROM hook_dead WHERE id IN (?)", delivered)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, q, args...)
+			return err
+		})
+		if err != nil {
+			wa.render.JSON(w, http.StatusInternalServerError,
+				map[string]string{"error": fmt.Sprintf("%s", err)})
+			return
+		}
+	}
+	wa.render.JSON(w, http.StatusOK, rsp)
+}
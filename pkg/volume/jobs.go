@@ -0,0 +1,197 @@
+package volume
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Job status
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+var jobSeq uint64
+
+// jobRetention finished jobs are kept this time
+var jobRetention = time.Hour
+
+/*
+Job a long task executed in background over a namespace.
+Counters are updated while the job is running, so it can be
+polled to follow its progress.
+*/
+type Job struct {
+	ID         string           `json:"id"`
+	Kind       string           `json:"kind"`
+	Namespace  string           `json:"namespace"`
+	Status     string           `json:"status"`
+	Counters   map[string]int64 `json:"counters"`
+	Error      string           `json:"error,omitempty"`
+	Result     interface{}      `json:"result,omitempty"`
+	StartedAt  time.Time        `json:"startedAt"`
+	FinishedAt *time.Time       `json:"finishedAt,omitempty"`
+	mu         sync.Mutex
+}
+
+// Add increments a counter of the job
+func (j *Job) Add(name string, n int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Counters[name] += n
+}
+
+// Set sets the value of a counter of the job
+func (j *Job) Set(name string, n int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Counters[name] = n
+}
+
+// SetResult sets the result of the job, it shouldn't be modified after
+func (j *Job) SetResult(v interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Result = v
+}
+
+func (j *Job) finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now().UTC()
+	j.FinishedAt = &now
+	j.Status = JobDone
+	if err != nil {
+		j.Status = JobFailed
+		j.Error = err.Error()
+	}
+}
+
+// snapshot copy of the job safe to be serialized
+func (j *Job) snapshot() *Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	c := &Job{
+		ID:         j.ID,
+		Kind:       j.Kind,
+		Namespace:  j.Namespace,
+		Status:     j.Status,
+		Counters:   map[string]int64{},
+		Error:      j.Error,
+		Result:     j.Result,
+		StartedAt:  j.StartedAt,
+		FinishedAt: j.FinishedAt,
+	}
+	for k, v := range j.Counters {
+		c.Counters[k] = v
+	}
+	return c
+}
+
+// expired the job finished before t
+func (j *Job) expired(t time.Time) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.FinishedAt != nil && j.FinishedAt.Before(t)
+}
+
+// JobFunc the work done by a job
+type JobFunc func(ctx context.Context, j *Job) error
+
+// Jobs registry of jobs started in this volume, the finished
+// jobs are removed after jobRetention.
+type Jobs struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// NewJobs creates an empty registry
+func NewJobs() *Jobs {
+	return &Jobs{jobs: map[string]*Job{}}
+}
+
+// Start runs f in a goroutine and returns the job to follow it
+func (js *Jobs) Start(kind, ns string, f JobFunc) *Job {
+	id := fmt.Sprintf("%s-%d", kind, atomic.AddUint64(&jobSeq, 1))
+	j := &Job{
+		ID:        id,
+		Kind:      kind,
+		Namespace: ns,
+		Status:    JobRunning,
+		Counters:  map[string]int64{},
+		StartedAt: time.Now().UTC(),
+	}
+	js.mu.Lock()
+	js.prune()
+	js.jobs[id] = j
+	js.mu.Unlock()
+
+	go func() {
+		err := f(context.Background(), j)
+		if err != nil {
+			log.Printf("Job %s failed: %s", id, err)
+		}
+		j.finish(err)
+	}()
+	return j.snapshot()
+}
+
+// prune removes the jobs finished before the retention, js.mu should be locked
+func (js *Jobs) prune() {
+	cutoff := time.Now().UTC().Add(-jobRetention)
+	for id, j := range js.jobs {
+		if j.expired(cutoff) {
+			delete(js.jobs, id)
+		}
+	}
+}
+
+// Get a job by id
+func (js *Jobs) Get(id string) (*Job, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	j, ok := js.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	return j.snapshot(), true
+}
+
+// List all the jobs, newest first
+func (js *Jobs) List() []*Job {
+	js.mu.Lock()
+	js.prune()
+	res := make([]*Job, 0, len(js.jobs))
+	for _, j := range js.jobs {
+		res = append(res, j.snapshot())
+	}
+	js.mu.Unlock()
+	sort.Slice(res, func(i, k int) bool {
+		return res[i].StartedAt.After(res[k].StartedAt)
+	})
+	return res
+}
+
+// AllJobs list the jobs started in this volume
+func (wa *WebApp) AllJobs(w http.ResponseWriter, r *http.Request) {
+	wa.render.JSON(w, http.StatusOK, wa.jobs.List())
+}
+
+// GetJob get the status of a job
+func (wa *WebApp) GetJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := wa.jobs.Get(chi.URLParam(r, "id"))
+	if !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Job not found"})
+		return
+	}
+	wa.render.JSON(w, http.StatusOK, j)
+}
@@ -0,0 +1,145 @@
+package volume
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/go-chi/chi/v5"
+)
+
+// Namespace modes
+const (
+	ModeReadWrite = "rw"
+	// ModeReadOnly the file is opened with mode=ro and writes are rejected
+	ModeReadOnly = "ro"
+	// ModeArchived read only, the file is opened with immutable=1 on the first access
+	ModeArchived = "archived"
+)
+
+func validMode(mode string) error {
+	switch mode {
+	case "", ModeReadWrite, ModeReadOnly, ModeArchived:
+		return nil
+	}
+	return fmt.Errorf("bad mode %q", mode)
+}
+
+// locked the namespace can't be written in this mode
+func locked(mode string) bool {
+	return mode == ModeReadOnly || mode == ModeArchived
+}
+
+// nsFile path of the main file of a namespace without the extension
+func (wa *WebApp) nsFile(ns string) string {
+	return fmt.Sprintf("%s/%s", wa.cfg.NSDir, ns)
+}
+
+/*
+openLocked opens read only a namespace in read-only or archived mode.
+It returns nil if the namespace is writable, the file doesn't exist or
+it has pending migrations, then the file should be opened for writes.
+*/
+func openLocked(path string, cfg *Config) *store.DB {
+	opts := *cfg.sqliteOptions()
+	opts.ReadOnly = true
+	db, err := store.OpenDB(path, &opts)
+	if err != nil {
+		return nil
+	}
+	var version int
+	if err := db.Get(&version, "PRAGMA user_version"); err != nil || version < len(migrations) {
+		db.Close()
+		return nil
+	}
+	o, err := getOptions(context.Background(), db)
+	if err != nil || !locked(o.Mode) {
+		db.Close()
+		return nil
+	}
+	if o.Mode == ModeArchived {
+		db.Close()
+		opts.Immutable = true
+		if db, err = store.OpenDB(path, &opts); err != nil {
+			log.Printf("Error opening archived namespace %s: %s", path, err)
+			return nil
+		}
+	}
+	return db
+}
+
+// writable rejects the writes to read-only and archived namespaces
+func (wa *WebApp) writable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ns := chi.URLParam(r, "ns")
+		if db, ok := wa.nsDB(ns); ok && db.ReadOnly {
+			wa.render.JSON(w, http.StatusLocked,
+				map[string]string{"error": "Namespace is read-only"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+setMode changes the mode of a namespace. The caller should hold a reference,
+the files are closed once the other requests and jobs release theirs, and
+the options written with writable connections, then the namespace is opened
+again in the new mode, read only files are checkpointed before that.
+Archived namespaces are left closed until the next access.
+*/
+func (wa *WebApp) setMode(ctx context.Context, ns string, o *NSOptions) error {
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	h, ok := wa.dbs[ns]
+	if !ok {
+		return fmt.Errorf("namespace not found")
+	}
+	if err := wa.exclusive(h); err != nil {
+		return err
+	}
+	defer wa.endExclusive(h)
+	if h.removed {
+		return fmt.Errorf("namespace not found")
+	}
+	paths := []string{wa.nsFile(ns)}
+	if p, ok := wa.parts[ns]; ok {
+		p.mu.RLock()
+		for _, part := range p.list {
+			if _, ok := p.dbs[part.Name]; ok {
+				paths = append(paths, wa.partPath(ns, part.Name))
+			}
+		}
+		p.mu.RUnlock()
+	}
+	wa.closeNS(ns, h)
+
+	var err error
+	for _, path := range paths {
+		var w *store.DB
+		if w, err = store.OpenDB(path, wa.cfg.sqliteOptions()); err != nil {
+			break
+		}
+		if err = putSetting(ctx, w.W, "options", o); err == nil {
+			err = w.Checkpoint(ctx)
+		}
+		w.Close()
+		if err != nil {
+			break
+		}
+	}
+	h.archived = err == nil && o.Mode == ModeArchived
+	if err != nil || h.archived {
+		// opened again on the next access
+		return err
+	}
+	if h.db, err = tryOpenNS(wa.nsFile(ns), dataSchemaV1, wa.cfg); err != nil {
+		return err
+	}
+	if err = wa.loadPartitions(ns, h.db); err != nil {
+		wa.closeNS(ns, h)
+	}
+	return err
+}
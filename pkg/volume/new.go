@@ -1,14 +1,16 @@
 package volume
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/algorinfo/rawstore/pkg/store"
 	"github.com/go-chi/chi/v5"
-	"github.com/jmoiron/sqlx"
 	"github.com/unrolled/render"
 )
 
@@ -21,11 +23,16 @@ func WithVolumes(ns []string) WebOption {
 
 }
 
+// WithProducer streams the events to redis
 func WithProducer(p *store.Producer) WebOption {
+	return WithPublisher(p)
+}
+
+// WithPublisher sends the events to any sink
+func WithPublisher(p store.Publisher) WebOption {
 	return func(w *WebApp) {
-		w.producer = p
+		w.publisher = p
 	}
-
 }
 
 func WithConfig(c *Config) WebOption {
@@ -36,14 +43,97 @@ func WithConfig(c *Config) WebOption {
 
 func DefaultConfig() *Config {
 	return &Config{
-		Addr:   "6667",
-		NSDir:  "data/",
-		Stream: false,
+		Addr:          "6667",
+		NSDir:         "data/",
+		Stream:        false,
+		MaxBodySize:   64 << 20,
+		MaxUploadSize: 8 << 30,
+		ChunkSize:     1 << 20,
+		SQLite:        store.DefaultSQLiteOptions(),
+		MaxOpenNS:     512,
+		IdleTimeout:   10 * time.Minute,
+		Writer:        store.DefaultWriterOptions(),
+
+		ChangelogRetention: 7 * 24 * time.Hour,
 	}
 
 }
 
-// LoadNS load namespace from the filesystem
+// openNS open or create the sqlite file of a namespace and
+// apply the pending migrations. If the namespace has its own sqlite
+// settings, they are merged over the global ones and the file is opened again.
+// Read-only and archived namespaces are opened read only once migrated.
+func openNS(path, schema string, cfg *Config) *store.DB {
+	db, err := tryOpenNS(path, schema, cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return db
+}
+
+// tryOpenNS like openNS but returning the errors, used for the namespaces
+// opened after the start.
+func tryOpenNS(path, schema string, cfg *Config) (*store.DB, error) {
+	if db := openLocked(path, cfg); db != nil {
+		return db, nil
+	}
+	opts := cfg.sqliteOptions()
+	db, err := store.OpenDB(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.W.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrate(db.W); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if n, err := discardUploads(db.W); err != nil {
+		log.Printf("Error removing unfinished uploads of %s: %s", path, err)
+	} else if n > 0 {
+		log.Printf("Removed %d chunks of unfinished uploads of %s", n, path)
+	}
+	if o, err := getOptions(context.Background(), db); err == nil && locked(o.Mode) {
+		if err := db.Checkpoint(context.Background()); err != nil {
+			log.Printf("Error checkpointing %s: %s", path, err)
+		}
+		db.Close()
+		if ro := openLocked(path, cfg); ro != nil {
+			return ro, nil
+		}
+		if db, err = store.OpenDB(path, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	var nsOpts store.SQLiteOptions
+	ok, err := getSetting(context.Background(), db, "sqlite", &nsOpts)
+	if err != nil {
+		log.Printf("Error reading sqlite settings of %s: %s", path, err)
+	}
+	if ok {
+		db.Close()
+		db, err = store.OpenDB(path, opts.Merge(&nsOpts))
+		if err != nil {
+			return nil, err
+		}
+	}
+	db.StartWriter(cfg.Writer)
+	return db, nil
+}
+
+// sqliteOptions global sqlite settings for the namespaces
+func (c *Config) sqliteOptions() *store.SQLiteOptions {
+	if c.SQLite == nil {
+		return store.DefaultSQLiteOptions()
+	}
+	return c.SQLite
+}
+
+// LoadNS registers the namespaces found in the filesystem,
+// they are opened on the first use.
 func LoadNS(wa *WebApp) error {
 
 	entries, err := os.ReadDir(wa.cfg.NSDir)
@@ -51,47 +141,79 @@ func LoadNS(wa *WebApp) error {
 		return err
 	}
 
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
 	for _, e := range entries {
 
-		nsName := strings.Split(e.Name(), ".db")[0]
+		// -wal, -shm and other files are not namespaces
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".db") {
+			continue
+		}
+		nsName := strings.TrimSuffix(e.Name(), ".db")
 		log.Printf("NS Loading for %s", nsName)
 
-		if nsName != "default" {
-
-			fullPath := fmt.Sprintf("%s/%s", wa.cfg.NSDir, nsName)
-			wa.namespaces = append(wa.namespaces, nsName)
-			wa.dbs[nsName] = store.CreateDB(fullPath, dataSchemaV1)
+		if _, ok := wa.dbs[nsName]; ok {
+			continue
 		}
+		wa.namespaces = append(wa.namespaces, nsName)
+		wa.dbs[nsName] = &nsHandle{name: nsName}
 	}
 	return nil
 }
 
+// CreateNS creates the file of a namespace and opens it, a namespace
+// which already exists is kept.
 func CreateNS(wa *WebApp, schema, ns string) error {
 
 	defPath := fmt.Sprintf("%s/%s", wa.cfg.NSDir, ns)
-	def := store.CreateDB(defPath, schema)
-	wa.dbs[ns] = def
+	def, err := tryOpenNS(defPath, schema, wa.cfg)
+	if err != nil {
+		return err
+	}
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	if _, ok := wa.dbs[ns]; ok {
+		// created meanwhile by another request
+		def.Close()
+		return nil
+	}
+	wa.dbs[ns] = &nsHandle{name: ns, db: def, lastUsed: time.Now()}
 	wa.namespaces = append(wa.namespaces, ns)
-	return nil
+	err = wa.loadPartitions(ns, def)
+	if err != nil {
+		wa.closeNS(ns, wa.dbs[ns])
+		return err
+	}
+	wa.checkHooks(def)
+	wa.evict(ns)
+	return err
 }
 
 // New creates a new Node instance
 func New(opts ...WebOption) *WebApp {
 
-	dbs := make(map[string]*sqlx.DB)
+	dbs := make(map[string]*nsHandle)
 
 	wa := &WebApp{
 		r:      chi.NewRouter(),
 		render: render.New(),
 		dbs:    dbs,
+		parts:  map[string]*partitions{},
 		cfg:    DefaultConfig(),
+		jobs:   NewJobs(),
+
+		hookWake: make(chan struct{}, 1),
+		relayed:  map[string]*relayState{},
 	}
+	wa.drained = sync.NewCond(&wa.mu)
 
 	for _, opt := range opts {
 		opt(wa)
 	}
 
-	CreateNS(wa, dataSchemaV1, "default")
+	if err := CreateNS(wa, dataSchemaV1, "default"); err != nil {
+		log.Fatalln(err)
+	}
 
 	if LoadNS(wa) != nil {
 		log.Printf("Error with dir %s", wa.cfg.NSDir)
@@ -100,12 +222,25 @@ func New(opts ...WebOption) *WebApp {
 	currDir, _ := os.Getwd()
 
 	log.Printf("Starting from %s", currDir)
-	if wa.producer != nil {
+	if wa.publisher != nil {
 		log.Printf("With stream enabled")
+		wa.relayWake = make(chan struct{}, 1)
+		go wa.relayLoop()
 	} else {
 		log.Printf("With stream disabled")
 	}
 
+	if wa.cfg.Watch {
+		if err := wa.Watch(); err != nil {
+			log.Printf("Error watching %s: %s", wa.cfg.NSDir, err)
+		}
+	}
+	if wa.cfg.IdleTimeout > 0 {
+		go wa.idleLoop(wa.cfg.IdleTimeout)
+	}
+	if wa.cfg.ChangelogRetention > 0 {
+		go wa.pruneLoop(wa.cfg.ChangelogRetention)
+	}
 	wa.RegisterRoutes()
 
 	return wa
@@ -0,0 +1,266 @@
+package volume
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/go-chi/chi/v5"
+)
+
+// uploadDir uploads are written here before they are checked, it's a dir
+// so the files aren't taken as namespaces.
+const uploadDir = "_upload"
+
+// ErrUploadTooLarge the uploaded file is bigger than MaxUploadSize
+var ErrUploadTooLarge = errors.New("upload too large")
+
+// validNSName rejects names which are not a file in NSDir,
+// or are used for the dirs of the volume.
+func validNSName(ns string) error {
+	if ns == "" || strings.HasPrefix(ns, "_") || strings.HasPrefix(ns, ".") ||
+		strings.ContainsAny(ns, `/\`) {
+		return fmt.Errorf("bad namespace name %q", ns)
+	}
+	return nil
+}
+
+// prepareUpload migrates an uploaded file to the last schema. The catalog
+// of partitions is removed, the files of the partitions are not uploaded.
+// With reset > 0 the changes of the file up to reset are marked as pruned,
+// see resetSeq.
+func prepareUpload(ctx context.Context, path string, cfg *Config, reset int64) error {
+	db, err := store.OpenDB(path, cfg.sqliteOptions())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.W.ExecContext(ctx, dataSchemaV1); err != nil {
+		return err
+	}
+	if err := migrate(db.W); err != nil {
+		return err
+	}
+	if _, err := db.W.ExecContext(ctx, "DELETE FROM settings WHERE name = 'partitions'"); err != nil {
+		return err
+	}
+	if reset > 0 {
+		var last int64
+		if err := db.W.GetContext(ctx, &last, "SELECT coalesce(max(seq), 0) FROM changes"); err != nil {
+			return err
+		}
+		if last >= reset {
+			reset = last + 1
+		}
+		if err := putSetting(ctx, db.W, "changelog", &changelogState{Pruned: reset}); err != nil {
+			return err
+		}
+	}
+	return db.Checkpoint(ctx)
+}
+
+// resetSeq the number the changelog of a replaced namespace starts from,
+// over the last one of the old files so the numbers never go backwards, and
+// marked as pruned so consumers get 410 and sync again. 0 if ns doesn't exist.
+func (wa *WebApp) resetSeq(ns string) (int64, error) {
+	h := wa.hold(ns, false)
+	if h == nil {
+		return 0, nil
+	}
+	defer wa.unhold(h, false)
+	if _, ok := wa.nsDB(ns); !ok {
+		return 0, fmt.Errorf("namespace %s could not be opened", ns)
+	}
+	cl := wa.changelog(ns)
+	if cl == nil {
+		return 0, fmt.Errorf("changelog of %s not available", ns)
+	}
+	return cl.lastSeq() + 1, nil
+}
+
+/*
+Upload creates or replaces a namespace with the sqlite file sent in the body,
+gzip compressed if Content-Encoding is gzip. The file is checked with
+integrity_check and migrated before it's moved to NSDir, so the namespace
+is only visible once it's complete. A namespace in use, read-only or
+archived is not replaced, the partitions of a replaced one are moved to the
+archive dir. The changelog of a replaced namespace goes on after the
+last number of the old one, its consumers get 410 and sync again. Files
+bigger than MaxUploadSize, compressed or not, are rejected with 413.
+*/
+func (wa *WebApp) Upload(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	if err := validNSName(ns); err != nil {
+		wa.render.JSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	limit := wa.cfg.MaxUploadSize
+	if limit > 0 && r.ContentLength > limit {
+		wa.render.JSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": ErrUploadTooLarge.Error()})
+		return
+	}
+	if limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	defer r.Body.Close()
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			if uploadTooLarge(err) {
+				wa.render.JSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": ErrUploadTooLarge.Error()})
+				return
+			}
+			wa.render.JSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("%s", err)})
+			return
+		}
+		defer gz.Close()
+		// the limit is for the file written too, not only the body
+		body = &limitedReader{r: gz, n: limit}
+	}
+
+	dir := filepath.Join(wa.cfg.NSDir, uploadDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	f, err := os.CreateTemp(dir, ns+"-*.db")
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	tmp := f.Name()
+	defer func() {
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			os.Remove(tmp + suffix)
+		}
+	}()
+	_, err = io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if uploadTooLarge(err) {
+		wa.render.JSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": ErrUploadTooLarge.Error()})
+		return
+	}
+	if err != nil {
+		wa.render.JSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+
+	if err := validNSFile(tmp, "integrity_check"); err != nil {
+		wa.render.JSON(w, http.StatusUnprocessableEntity, map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	reset, err := wa.resetSeq(ns)
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	if err := prepareUpload(r.Context(), strings.TrimSuffix(tmp, ".db"), wa.cfg, reset); err != nil {
+		wa.render.JSON(w, http.StatusUnprocessableEntity, map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+
+	status, err := wa.replaceNS(ns, tmp, reset)
+	if err != nil {
+		wa.render.JSON(w, status, map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	wa.render.JSON(w, status, map[string]string{"namespace": ns})
+}
+
+// uploadTooLarge the body or the decompressed file went over MaxUploadSize
+func uploadTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr) || errors.Is(err, ErrObjectTooLarge)
+}
+
+// replaceNS moves an uploaded file to the namespace, it returns the
+// status of the response. reset is the one the file was prepared with,
+// it fails if the namespace was created or written since then.
+func (wa *WebApp) replaceNS(ns, tmp string, reset int64) (int, error) {
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	h, exists := wa.dbs[ns]
+	if exists && (h.refs > 0 || h.removed) {
+		return http.StatusConflict, fmt.Errorf("namespace %s is in use", ns)
+	}
+	if exists && wa.nsLocked(ns, h) {
+		return http.StatusLocked, fmt.Errorf("namespace %s is read-only", ns)
+	}
+	if exists && (reset == 0 || h.changes == nil || h.changes.lastSeq() >= reset) {
+		return http.StatusConflict, fmt.Errorf("namespace %s changed during the upload", ns)
+	}
+
+	path := filepath.Join(wa.cfg.NSDir, ns+".db")
+	if exists {
+		wa.closeNS(ns, h)
+		wa.forgetRelay(wa.nsFile(ns) + ".db")
+		// the WAL of the old file must not be applied to the new one
+		for _, suffix := range []string{"-wal", "-shm"} {
+			os.Remove(path + suffix)
+		}
+		if err := wa.archivePartitions(ns); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if exists {
+		h.archived = false
+		// loaded again from the new file, which starts after reset
+		h.changes = nil
+		return http.StatusOK, nil
+	}
+	wa.dbs[ns] = &nsHandle{name: ns}
+	wa.namespaces = append(wa.namespaces, ns)
+	return http.StatusCreated, nil
+}
+
+// nsLocked the namespace is in read-only or archived mode, closed
+// namespaces are checked on the file. wa.mu should be locked.
+func (wa *WebApp) nsLocked(ns string, h *nsHandle) bool {
+	if h.db != nil {
+		return h.db.ReadOnly
+	}
+	if h.archived {
+		return true
+	}
+	if db := openLocked(wa.nsFile(ns), wa.cfg); db != nil {
+		db.Close()
+		return true
+	}
+	return false
+}
+
+// archivePartitions moves the partition files of a namespace which is
+// replaced to the archive dir.
+func (wa *WebApp) archivePartitions(ns string) error {
+	files, _ := filepath.Glob(filepath.Join(wa.cfg.NSDir, ns, "*.db"))
+	if len(files) == 0 {
+		return nil
+	}
+	dst := filepath.Join(wa.cfg.NSDir, archiveDir, ns, time.Now().UTC().Format("20060102-150405"))
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.Rename(f, filepath.Join(dst, filepath.Base(f))); err != nil {
+			return err
+		}
+		for _, suffix := range []string{"-wal", "-shm"} {
+			os.Remove(f + suffix)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package volume
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// NSOptions behaviour of a namespace, stored in its settings
+type NSOptions struct {
+	// Dedup stores identical payloads only once
+	Dedup bool `json:"dedup"`
+	// Partition rolls the writes into a new file by period or size
+	Partition *PartitionConfig `json:"partition,omitempty"`
+	// Mode rw (default), ro or archived
+	Mode string `json:"mode,omitempty"`
+}
+
+// validate checks the options sent by a client
+func (o *NSOptions) validate() error {
+	if err := validMode(o.Mode); err != nil {
+		return err
+	}
+	if o.Partition != nil {
+		return o.Partition.validate()
+	}
+	return nil
+}
+
+// getOptions of a namespace, the defaults are returned if they aren't defined
+func getOptions(ctx context.Context, db sqlx.QueryerContext) (*NSOptions, error) {
+	o := &NSOptions{}
+	_, err := getSetting(ctx, db, "options", o)
+	return o, err
+}
+
+// GetOptions returns the options of a namespace
+func (wa *WebApp) GetOptions(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	db, ok := wa.nsDB(ns)
+	if !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	o, err := getOptions(r.Context(), db)
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	wa.render.JSON(w, http.StatusOK, o)
+}
+
+// PutOptions changes the options of a namespace, objects already
+// stored are not modified. It's allowed on read-only namespaces,
+// so they can be made writable again.
+func (wa *WebApp) PutOptions(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	db, ok := wa.nsDB(ns)
+	if !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var o NSOptions
+	err = json.Unmarshal(b, &o)
+	if err == nil {
+		err = o.validate()
+	}
+	if err != nil {
+		wa.render.JSON(w, http.StatusBadRequest,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	if db.ReadOnly || locked(o.Mode) {
+		err = wa.setMode(r.Context(), ns, &o)
+	} else {
+		err = wa.putNSSetting(r.Context(), ns, "options", &o)
+	}
+	if errors.Is(err, ErrNSBusy) {
+		wa.render.JSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	// not read again, archived namespaces are closed
+	wa.render.JSON(w, http.StatusOK, &o)
+}
+
+// putNSSetting saves a setting in the main file of a namespace and its
+// open partitions, so they apply to the writes of any of them.
+func (wa *WebApp) putNSSetting(ctx context.Context, ns, name string, v interface{}) error {
+	for _, db := range wa.nsDBs(ns) {
+		if err := putSetting(ctx, db.W, name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package volume
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// relayInterval pending events are checked at least this often
+	relayInterval = time.Second
+	// relayBatch max events sent from a file in each pass
+	relayBatch = 100
+	// relayMaxBackoff max wait between the retries of an event
+	relayMaxBackoff = 5 * time.Minute
+	// outboxRetention sent events are kept this time
+	outboxRetention = 24 * time.Hour
+)
+
+// outboxRow an event waiting in the outbox of a file
+type outboxRow struct {
+	ID       int64  `db:"id"`
+	Event    string `db:"event"`
+	Attempts int    `db:"attempts"`
+	NextAt   string `db:"next_at"`
+}
+
+/*
+relayState progress of the relay over a read-only file, the outbox can't
+be written until the file is writable again, then the events sent are marked.
+The state is lost on restart, so those events could be sent again.
+*/
+type relayState struct {
+	// sent last id sent
+	sent     int64
+	attempts int
+	nextAt   time.Time
+}
+
+// record writes the events to the changelog, and to the outbox when there
+// is a stream, in the transaction of the change, so an event exists only
+// if the change is committed.
+func (wa *WebApp) record(ctx context.Context, tx *sqlx.Tx, events ...*Event) error {
+	for _, e := range events {
+		if e.Seq > 0 {
+			_, err := tx.ExecContext(ctx, `INSERT INTO changes (seq, type, data_id, size, checksum, request_id, created_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?)`, e.Seq, e.Type, e.Key, e.Size, e.Checksum, e.RequestID, e.Timestamp)
+			if err != nil {
+				return err
+			}
+		}
+		if wa.publisher == nil {
+			continue
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO outbox (event) VALUES (?)", string(b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wakeRelay tells the relay that there are new events
+func (wa *WebApp) wakeRelay() {
+	if wa.relayWake == nil {
+		return
+	}
+	select {
+	case wa.relayWake <- struct{}{}:
+	default:
+	}
+}
+
+// backoff wait before the next attempt of an event
+func backoff(attempts int) time.Duration {
+	if attempts > 16 {
+		return relayMaxBackoff
+	}
+	d := time.Second << attempts
+	if d > relayMaxBackoff {
+		return relayMaxBackoff
+	}
+	return d
+}
+
+/*
+relayDB sends the pending events of a file in order. When an event fails
+it's retried later with backoff and the next events of the file wait for it,
+so consumers receive the changes of a file in the order they were done.
+The events of read-only files are sent too, their progress is kept in
+memory until the file is writable again. It returns the events sent.
+*/
+func (wa *WebApp) relayDB(ctx context.Context, ns string, db *store.DB) (int, error) {
+	wa.relayMu.Lock()
+	st := wa.relayed[db.Path]
+	wa.relayMu.Unlock()
+	if st != nil && !db.ReadOnly {
+		// events sent while the file was read-only
+		err := db.Write(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+			_, err := tx.ExecContext(ctx, `UPDATE outbox SET sent_at = CURRENT_TIMESTAMP
+				WHERE sent_at IS NULL AND id <= ?`, st.sent)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		wa.relayMu.Lock()
+		delete(wa.relayed, db.Path)
+		wa.relayMu.Unlock()
+		st = nil
+	}
+	if db.ReadOnly {
+		if st == nil {
+			st = &relayState{}
+		}
+		if time.Now().Before(st.nextAt) {
+			return 0, nil
+		}
+		defer func() {
+			wa.relayMu.Lock()
+			wa.relayed[db.Path] = st
+			wa.relayMu.Unlock()
+		}()
+	}
+	var after int64
+	if st != nil {
+		after = st.sent
+	}
+
+	rows := []outboxRow{}
+	err := db.SelectContext(ctx, &rows, `SELECT id, event, attempts, coalesce(next_at, '') AS next_at
+		FROM outbox WHERE sent_at IS NULL AND id > ? ORDER BY id LIMIT ?`, after, relayBatch)
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+
+	sent := []int64{}
+	var sendErr error
+	now := time.Now().UTC().Format(sqliteTime)
+	for _, row := range rows {
+		if row.NextAt > now {
+			// waiting for a retry
+			break
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(row.Event), &e); err != nil {
+			// it could never be sent, so it doesn't block the rest
+			log.Printf("Dropping bad event %d of %s: %s", row.ID, ns, err)
+			sent = append(sent, row.ID)
+			continue
+		}
+		// the namespace is the current name of the file
+		e.Namespace = ns
+		if sendErr = wa.publisher.Publish(ctx, ns, e.values()); sendErr != nil {
+			if st != nil {
+				st.nextAt = time.Now().Add(backoff(st.attempts))
+				st.attempts++
+				break
+			}
+			wait := backoff(row.Attempts)
+			_ = db.Write(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+				_, err := tx.ExecContext(ctx, `UPDATE outbox SET attempts = attempts + 1, last_error = ?,
+					next_at = ? WHERE id = ?`,
+					sendErr.Error(), time.Now().UTC().Add(wait).Format(sqliteTime), row.ID)
+				return err
+			})
+			break
+		}
+		sent = append(sent, row.ID)
+	}
+
+	if len(sent) > 0 && st != nil {
+		st.sent = sent[len(sent)-1]
+		if sendErr == nil {
+			st.attempts = 0
+		}
+	} else if len(sent) > 0 {
+		err = db.Write(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+			q, args, err := sqlx.In("UPDATE outbox SET sent_at = CURRENT_TIMESTAMP WHERE id IN (?)", sent)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, q, args...)
+			return err
+		})
+	}
+	if err == nil {
+		err = sendErr
+	}
+	return len(sent), err
+}
+
+// forgetRelay drops the progress of the relay over a file which is
+// replaced or removed
+func (wa *WebApp) forgetRelay(path string) {
+	wa.relayMu.Lock()
+	defer wa.relayMu.Unlock()
+	delete(wa.relayed, path)
+}
+
+// pruneOutbox removes the events sent before the retention
+func pruneOutbox(ctx context.Context, db *store.DB) error {
+	return db.Write(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM outbox WHERE sent_at < ?",
+			time.Now().UTC().Add(-outboxRetention).Format(sqliteTime))
+		return err
+	})
+}
+
+// openNames namespaces open, background work doesn't open the closed ones,
+// the pending events are sent the next time they are opened.
+func (wa *WebApp) openNames() []string {
+	wa.mu.RLock()
+	defer wa.mu.RUnlock()
+	names := []string{}
+	for ns, h := range wa.dbs {
+		if h.db != nil && !h.removed {
+			names = append(names, ns)
+		}
+	}
+	return names
+}
+
+// relayLoop sends the events of the outbox of every open namespace
+func (wa *WebApp) relayLoop() {
+	tick := time.NewTicker(relayInterval)
+	defer tick.Stop()
+	lastPrune := time.Now()
+	for {
+		select {
+		case <-tick.C:
+		case <-wa.relayWake:
+		}
+		prune := time.Since(lastPrune) > time.Minute
+		if prune {
+			lastPrune = time.Now()
+		}
+		ctx := context.Background()
+		for _, ns := range wa.openNames() {
+			h, _ := wa.holdOpen(ns, true)
+			if h == nil {
+				continue
+			}
+			for _, db := range wa.nsDBs(ns) {
+				if _, err := wa.relayDB(ctx, ns, db); err != nil {
+					log.Printf("Error relaying events of %s: %s", wa.fileLabel(ns, db), err)
+				}
+				if prune && !db.ReadOnly {
+					if err := pruneOutbox(ctx, db); err != nil {
+						log.Printf("Error pruning outbox of %s: %s", wa.fileLabel(ns, db), err)
+					}
+				}
+			}
+			wa.unhold(h, false)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package volume
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/go-chi/chi/v5"
+)
+
+// Partition modes
+const (
+	PartitionByDay   = "day"
+	PartitionByMonth = "month"
+	PartitionBySize  = "size"
+)
+
+// Partition states
+const (
+	PartitionOpen     = "open"
+	PartitionArchived = "archived"
+)
+
+// archiveDir archived partitions are moved to this dir inside NSDir
+const archiveDir = "_archive"
+
+/*
+PartitionConfig how the writes of a namespace are rolled into new files.
+With day and month a new file is started when the period changes,
+with size when the current file is bigger than MaxBytes.
+*/
+type PartitionConfig struct {
+	By       string `json:"by"`
+	MaxBytes int64  `json:"maxBytes,omitempty"`
+}
+
+func (c *PartitionConfig) validate() error {
+	switch c.By {
+	case PartitionByDay, PartitionByMonth:
+		return nil
+	case PartitionBySize:
+		if c.MaxBytes <= 0 {
+			return fmt.Errorf("maxBytes is required to partition by size")
+		}
+		return nil
+	}
+	return fmt.Errorf("bad partition mode %q", c.By)
+}
+
+// name of the partition for the writes done at t
+func (c *PartitionConfig) name(t time.Time) string {
+	switch c.By {
+	case PartitionByDay:
+		return t.Format("2006-01-02")
+	case PartitionByMonth:
+		return t.Format("2006-01")
+	}
+	return t.Format("20060102-150405")
+}
+
+// Partition a file of a partitioned namespace
+type Partition struct {
+	Name      string `json:"name"`
+	State     string `json:"state"`
+	CreatedAt string `json:"createdAt"`
+}
+
+/*
+partitions of a namespace, the catalog is kept in the settings of
+the main file of the namespace, which is still read after the partitions,
+so objects written before partitioning are found.
+*/
+type partitions struct {
+	mu sync.RWMutex
+	// list oldest first
+	list []*Partition
+	// dbs open partitions by name
+	dbs map[string]*store.DB
+}
+
+func newPartitions() *partitions {
+	return &partitions{dbs: map[string]*store.DB{}}
+}
+
+// find index of a partition in the list, -1 if it doesn't exist
+func (p *partitions) find(name string) int {
+	for i, part := range p.list {
+		if part.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// partPath path of a partition file without the extension
+func (wa *WebApp) partPath(ns, name string) string {
+	return filepath.Join(wa.cfg.NSDir, ns, name)
+}
+
+// loadPartitions opens the partitions of the catalog of a namespace,
+// wa.mu should be locked. On error the namespace should be closed,
+// its objects can't be read without all its partitions.
+func (wa *WebApp) loadPartitions(ns string, base *store.DB) error {
+	p, err := wa.openPartitions(ns, base)
+	if err != nil {
+		return err
+	}
+	wa.parts[ns] = p
+	return nil
+}
+
+// openPartitions opens the partitions of the catalog of a namespace
+// without registering them, wa.mu isn't needed. On error the ones
+// already opened are closed.
+func (wa *WebApp) openPartitions(ns string, base *store.DB) (*partitions, error) {
+	p := newPartitions()
+	if _, err := getSetting(context.Background(), base, "partitions", &p.list); err != nil {
+		return nil, err
+	}
+	for _, part := range p.list {
+		if part.State != PartitionOpen {
+			continue
+		}
+		db, err := tryOpenNS(wa.partPath(ns, part.Name), dataSchemaV1, wa.cfg)
+		if err != nil {
+			for _, db := range p.dbs {
+				db.Close()
+			}
+			return nil, fmt.Errorf("partition %s: %w", part.Name, err)
+		}
+		p.dbs[part.Name] = db
+	}
+	return p, nil
+}
+
+// nsDBs files of a namespace which should be read, newest first
+func (wa *WebApp) nsDBs(ns string) []*store.DB {
+	dbs := []*store.DB{}
+	base, ok := wa.nsDB(ns)
+	if !ok {
+		return dbs
+	}
+	if p, ok := wa.nsParts(ns); ok {
+		p.mu.RLock()
+		for i := len(p.list) - 1; i >= 0; i-- {
+			if db, ok := p.dbs[p.list[i].Name]; ok {
+				dbs = append(dbs, db)
+			}
+		}
+		p.mu.RUnlock()
+	}
+	return append(dbs, base)
+}
+
+// fileLabel name of a file of a namespace used in stats and reports,
+// ns for the main file and ns/partition for the partitions.
+func (wa *WebApp) fileLabel(ns string, db *store.DB) string {
+	if base, _ := wa.nsDB(ns); db == base {
+		return ns
+	}
+	return ns + "/" + strings.TrimSuffix(filepath.Base(db.Path), ".db")
+}
+
+// findDB the file of a namespace which has key, nil if no one has it
+func (wa *WebApp) findDB(ctx context.Context, ns, key string) (*store.DB, error) {
+	for _, db := range wa.nsDBs(ns) {
+		ok, err := dataExists(ctx, db, key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return db, nil
+		}
+	}
+	return nil, nil
+}
+
+// writeDB the file where new objects of a namespace are written,
+// for partitioned namespaces a new partition is started if needed.
+func (wa *WebApp) writeDB(ctx context.Context, ns string) (*store.DB, error) {
+	base, ok := wa.nsDB(ns)
+	if !ok {
+		return nil, fmt.Errorf("namespace not found")
+	}
+	opts, err := getOptions(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Partition == nil {
+		return base, nil
+	}
+	p, _ := wa.nsParts(ns)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now().UTC()
+	name := opts.Partition.name(now)
+	if n := len(p.list); n > 0 {
+		cur := p.list[n-1]
+		db, open := p.dbs[cur.Name]
+		rotate := !open || cur.Name != name
+		if opts.Partition.By == PartitionBySize && open {
+			rotate = diskSize(db.Path) >= opts.Partition.MaxBytes
+		}
+		if !rotate {
+			return db, nil
+		}
+	}
+	return wa.addPartition(ctx, base, ns, p, name, now)
+}
+
+// addPartition creates a new partition with the settings of the namespace,
+// p should be locked.
+func (wa *WebApp) addPartition(ctx context.Context, base *store.DB, ns string, p *partitions, name string, now time.Time) (*store.DB, error) {
+	// with size rotation two partitions could be started in the same second
+	prefix := name
+	for i := 2; p.find(name) >= 0; i++ {
+		name = fmt.Sprintf("%s-%d", prefix, i)
+	}
+	if err := os.MkdirAll(filepath.Join(wa.cfg.NSDir, ns), os.ModePerm); err != nil {
+		return nil, err
+	}
+	db, err := tryOpenNS(wa.partPath(ns, name), dataSchemaV1, wa.cfg)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite settings are applied the next time the partition is opened
+	for _, k := range []string{"quota", "options", "sqlite"} {
+		var v json.RawMessage
+		ok, err := getSetting(ctx, base, k, &v)
+		if err == nil && ok {
+			err = putSetting(ctx, db.W, k, v)
+		}
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	list := append(p.list, &Partition{Name: name, State: PartitionOpen, CreatedAt: now.Format(sqliteTime)})
+	if err := putSetting(ctx, base.W, "partitions", list); err != nil {
+		db.Close()
+		return nil, err
+	}
+	p.list = list
+	p.dbs[name] = db
+	return db, nil
+}
+
+// PartitionInfo a partition and the size of its file
+type PartitionInfo struct {
+	*Partition
+	Objects  int64 `json:"objects"`
+	FileSize int64 `json:"fileSize"`
+}
+
+// AllPartitions list the partitions of a namespace, oldest first
+func (wa *WebApp) AllPartitions(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	p, ok := wa.nsParts(ns)
+	if !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	p.mu.RLock()
+	res := make([]*PartitionInfo, 0, len(p.list))
+	for _, part := range p.list {
+		info := &PartitionInfo{Partition: part}
+		if db, ok := p.dbs[part.Name]; ok {
+			_ = db.GetContext(r.Context(), &info.Objects, "SELECT count(*) FROM data")
+			info.FileSize = diskSize(db.Path)
+		}
+		res = append(res, info)
+	}
+	p.mu.RUnlock()
+	wa.render.JSON(w, http.StatusOK, res)
+}
+
+// DropPartition deletes the file of a partition with all its objects.
+// With POST .../_archive the file is moved to the archive dir instead,
+// and its objects are not read anymore. It waits for the requests and
+// jobs using the namespace, so the file isn't closed while it's read.
+func (wa *WebApp) DropPartition(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	name := chi.URLParam(r, "part")
+	if _, ok := wa.nsDB(ns); !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	archive := r.Method == http.MethodPost
+
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	h, ok := wa.dbs[ns]
+	if !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	if err := wa.exclusive(h); err != nil {
+		wa.render.JSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	defer wa.endExclusive(h)
+	p, ok := wa.parts[ns]
+	if h.removed || h.db == nil || !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := p.find(name)
+	if i < 0 {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Partition not found"})
+		return
+	}
+	if i == len(p.list)-1 {
+		wa.render.JSON(w, http.StatusConflict,
+			map[string]string{"error": "the last partition receives the writes"})
+		return
+	}
+
+	list := make([]*Partition, 0, len(p.list))
+	for _, part := range p.list {
+		if part.Name != name {
+			list = append(list, part)
+		} else if archive {
+			list = append(list, &Partition{Name: name, State: PartitionArchived, CreatedAt: part.CreatedAt})
+		}
+	}
+	if db, ok := p.dbs[name]; ok {
+		db.Close()
+		delete(p.dbs, name)
+	}
+
+	var err error
+	path := wa.partPath(ns, name) + ".db"
+	wa.forgetRelay(path)
+	if archive {
+		dst := filepath.Join(wa.cfg.NSDir, archiveDir, ns)
+		if err = os.MkdirAll(dst, os.ModePerm); err == nil {
+			err = os.Rename(path, filepath.Join(dst, name+".db"))
+		}
+	} else {
+		err = os.Remove(path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+
+	if err := putSetting(r.Context(), h.db.W, "partitions", list); err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	p.list = list
+	wa.render.JSON(w, http.StatusOK, p.list)
+}
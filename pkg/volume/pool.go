@@ -0,0 +1,368 @@
+package volume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/go-chi/chi/v5"
+)
+
+/*
+nsHandle a namespace known by the volume. The files are opened on the
+first use and closed when the namespace is idle or when too many namespaces
+are open, but never while a request or a job holds a reference.
+*/
+type nsHandle struct {
+	name string
+	// db main file, nil while the namespace is closed
+	db *store.DB
+	// refs requests and jobs using the namespace
+	refs     int
+	lastUsed time.Time
+	// archived mode, known once the namespace was opened
+	archived bool
+	// removed the file was removed from the dir, it's closed
+	// when the last reference is released
+	removed bool
+	// changes sequence of the changelog, loaded on the first use
+	changes *changelog
+	// busy an exclusive operation is changing the files
+	busy bool
+	// drain closed when an exclusive operation starts waiting
+	drain chan struct{}
+	// opening closed once the files being opened by nsDB are set
+	opening chan struct{}
+}
+
+// drainTimeout how long an exclusive operation waits for the
+// requests and jobs using the namespace
+var drainTimeout = 30 * time.Second
+
+// ErrNSBusy the namespace is used by another exclusive operation or
+// its references were not released in time
+var ErrNSBusy = errors.New("namespace is busy")
+
+// nsDB main file of a namespace, closed namespaces are opened
+// on the first access.
+func (wa *WebApp) nsDB(ns string) (*store.DB, bool) {
+	wa.mu.RLock()
+	h, ok := wa.dbs[ns]
+	var db *store.DB
+	if ok {
+		db = h.db
+		ok = !h.removed
+	}
+	wa.mu.RUnlock()
+	if !ok || db != nil {
+		return db, ok
+	}
+
+	// the files are opened, and migrated if they are old, without wa.mu,
+	// other callers wait on opening. The reference taken meanwhile keeps
+	// the namespace from being closed or replaced.
+	wa.mu.Lock()
+	for {
+		if h, ok = wa.dbs[ns]; !ok || h.removed {
+			wa.mu.Unlock()
+			return nil, false
+		}
+		if h.db != nil || h.opening == nil {
+			break
+		}
+		opening := h.opening
+		wa.mu.Unlock()
+		<-opening
+		wa.mu.Lock()
+	}
+	if h.db != nil {
+		db = h.db
+		wa.mu.Unlock()
+		return db, true
+	}
+	opening := make(chan struct{})
+	h.opening = opening
+	h.refs++
+	wa.mu.Unlock()
+	defer wa.unhold(h, false)
+
+	db, p, err := wa.openNSFiles(ns)
+
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	h.opening = nil
+	close(opening)
+	if err != nil {
+		log.Printf("Error opening namespace %s: %s", ns, err)
+		return nil, false
+	}
+	if h.removed {
+		closeFiles(db, p)
+		return nil, false
+	}
+	h.db = db
+	wa.parts[ns] = p
+	h.lastUsed = time.Now()
+	if o, err := getOptions(context.Background(), db); err == nil {
+		h.archived = o.Mode == ModeArchived
+	}
+	wa.checkHooks(db)
+	wa.evict(ns)
+	return db, true
+}
+
+// openNSFiles opens the main file of a namespace and its partitions
+func (wa *WebApp) openNSFiles(ns string) (*store.DB, *partitions, error) {
+	db, err := tryOpenNS(wa.nsFile(ns), dataSchemaV1, wa.cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := wa.openPartitions(ns, db)
+	if err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("partitions: %w", err)
+	}
+	return db, p, nil
+}
+
+// closeFiles closes the files opened by openNSFiles
+func closeFiles(db *store.DB, p *partitions) {
+	for _, pdb := range p.dbs {
+		pdb.Close()
+	}
+	db.Close()
+}
+
+// nsNames names of the namespaces of the volume
+func (wa *WebApp) nsNames() []string {
+	wa.mu.RLock()
+	defer wa.mu.RUnlock()
+	return append([]string{}, wa.namespaces...)
+}
+
+// nsParts partitions of a namespace, opening it if it's closed
+func (wa *WebApp) nsParts(ns string) (*partitions, bool) {
+	if _, ok := wa.nsDB(ns); !ok {
+		return nil, false
+	}
+	wa.mu.RLock()
+	defer wa.mu.RUnlock()
+	p, ok := wa.parts[ns]
+	return p, ok
+}
+
+// acquire takes a reference on a namespace, so it isn't closed until
+// release is called. It returns nil if the namespace doesn't exist.
+func (wa *WebApp) acquire(ns string) *nsHandle {
+	return wa.hold(ns, true)
+}
+
+// release a reference taken with acquire
+func (wa *WebApp) release(h *nsHandle) {
+	wa.unhold(h, true)
+}
+
+// hold takes a reference, with touch the namespace is marked as used.
+// Background work doesn't touch, so it doesn't keep idle namespaces open.
+func (wa *WebApp) hold(ns string, touch bool) *nsHandle {
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	h, ok := wa.dbs[ns]
+	if !ok || h.removed {
+		return nil
+	}
+	h.refs++
+	if touch {
+		h.lastUsed = time.Now()
+	}
+	return h
+}
+
+// holdOpen takes a reference only if the namespace is open, so background
+// work never opens namespaces. Archived namespaces are skipped unless
+// archived is true, for work which only reads. It returns the main file,
+// or nil if the namespace was skipped.
+func (wa *WebApp) holdOpen(ns string, archived bool) (*nsHandle, *store.DB) {
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	h, ok := wa.dbs[ns]
+	if !ok || h.removed || h.db == nil || (h.archived && !archived) || h.busy {
+		return nil, nil
+	}
+	h.refs++
+	return h, h.db
+}
+
+// unhold releases a reference taken with hold
+func (wa *WebApp) unhold(h *nsHandle, touch bool) {
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	if h.refs > 0 {
+		h.refs--
+	}
+	if h.busy {
+		wa.drained.Broadcast()
+	}
+	if touch {
+		h.lastUsed = time.Now()
+	}
+	if h.removed && h.refs == 0 {
+		wa.closeNS(h.name, h)
+		delete(wa.dbs, h.name)
+	}
+}
+
+/*
+exclusive waits until the caller, which holds one reference, is the only
+one using the namespace, so its files can be closed or replaced. Long
+requests are told to return with draining and background work doesn't
+take new references meanwhile. wa.mu should be locked, it's released while
+waiting, and kept locked until endExclusive once the files are changed.
+*/
+func (wa *WebApp) exclusive(h *nsHandle) error {
+	if h.busy {
+		return ErrNSBusy
+	}
+	h.busy = true
+	if h.drain != nil {
+		close(h.drain)
+		h.drain = nil
+	}
+	deadline := time.Now().Add(drainTimeout)
+	t := time.AfterFunc(drainTimeout, func() {
+		wa.mu.Lock()
+		defer wa.mu.Unlock()
+		wa.drained.Broadcast()
+	})
+	defer t.Stop()
+	for h.refs > 1 {
+		if !time.Now().Before(deadline) {
+			h.busy = false
+			return ErrNSBusy
+		}
+		wa.drained.Wait()
+	}
+	return nil
+}
+
+// endExclusive ends an exclusive operation, wa.mu should be locked
+func (wa *WebApp) endExclusive(h *nsHandle) {
+	h.busy = false
+}
+
+// draining returns a channel closed when an exclusive operation waits
+// for the namespace, requests which stream should return then.
+func (wa *WebApp) draining(ns string) <-chan struct{} {
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	h, ok := wa.dbs[ns]
+	if !ok {
+		return nil
+	}
+	if h.busy {
+		c := make(chan struct{})
+		close(c)
+		return c
+	}
+	if h.drain == nil {
+		h.drain = make(chan struct{})
+	}
+	return h.drain
+}
+
+// holdNS keeps the namespace of the request open until the response is sent
+func (wa *WebApp) holdNS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h := wa.acquire(chi.URLParam(r, "ns")); h != nil {
+			defer wa.release(h)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startNSJob starts a job holding a reference on its namespace
+func (wa *WebApp) startNSJob(kind, ns string, f JobFunc) *Job {
+	h := wa.acquire(ns)
+	return wa.jobs.Start(kind, ns, func(ctx context.Context, j *Job) error {
+		if h != nil {
+			defer wa.release(h)
+		}
+		return f(ctx, j)
+	})
+}
+
+// closeNS closes the files of a namespace, wa.mu should be locked
+func (wa *WebApp) closeNS(ns string, h *nsHandle) {
+	if p, ok := wa.parts[ns]; ok {
+		p.mu.Lock()
+		for name, db := range p.dbs {
+			db.Close()
+			delete(p.dbs, name)
+		}
+		p.mu.Unlock()
+		delete(wa.parts, ns)
+	}
+	if h.db != nil {
+		h.db.Close()
+		h.db = nil
+	}
+}
+
+// evict closes the least recently used namespaces not in use while
+// more than MaxOpenNS are open, keep is not closed. wa.mu should be locked.
+func (wa *WebApp) evict(keep string) {
+	if wa.cfg.MaxOpenNS <= 0 {
+		return
+	}
+	open := 0
+	for _, h := range wa.dbs {
+		if h.db != nil {
+			open++
+		}
+	}
+	for ; open > wa.cfg.MaxOpenNS; open-- {
+		var lru string
+		var oldest *nsHandle
+		for ns, h := range wa.dbs {
+			if h.db == nil || h.refs > 0 || ns == keep {
+				continue
+			}
+			if oldest == nil || h.lastUsed.Before(oldest.lastUsed) {
+				lru, oldest = ns, h
+			}
+		}
+		if oldest == nil {
+			// everything is in use
+			return
+		}
+		log.Printf("Closing namespace %s, %d namespaces open", lru, open)
+		wa.closeNS(lru, oldest)
+	}
+}
+
+// closeIdle closes the namespaces not used for more than idle
+func (wa *WebApp) closeIdle(idle time.Duration) {
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	for ns, h := range wa.dbs {
+		if h.db != nil && h.refs == 0 && time.Since(h.lastUsed) > idle {
+			log.Printf("Closing idle namespace %s", ns)
+			wa.closeNS(ns, h)
+		}
+	}
+}
+
+// idleLoop checks periodically for idle namespaces
+func (wa *WebApp) idleLoop(idle time.Duration) {
+	every := idle / 2
+	if every > time.Minute {
+		every = time.Minute
+	}
+	for range time.Tick(every) {
+		wa.closeIdle(idle)
+	}
+}
@@ -0,0 +1,236 @@
+package volume
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+)
+
+// sqliteTime is the format used by CURRENT_TIMESTAMP in sqlite (UTC)
+const sqliteTime = "2006-01-02 15:04:05"
+
+// sortColumns allowed values for the sort param
+var sortColumns = map[string]string{
+	"created": "created_at",
+	"updated": "updated_at",
+	"key":     "data_id",
+	"size":    "size",
+}
+
+// listFilter conditions shared by the endpoints which list objects
+type listFilter struct {
+	Prefix string
+	Tags   Tags
+	Since  string
+	Until  string
+	Sort   string
+	Order  string
+}
+
+// parseTime accepts RFC3339, "2006-01-02 15:04:05" or "2006-01-02"
+// and returns it in the sqlite format.
+func parseTime(v string) (string, error) {
+	for _, layout := range []string{time.RFC3339, sqliteTime, "2006-01-02"} {
+		t, err := time.Parse(layout, v)
+		if err == nil {
+			return t.UTC().Format(sqliteTime), nil
+		}
+	}
+	return "", fmt.Errorf("bad time %q", v)
+}
+
+// parseListFilter read the filter options from the query params
+// since (inclusive) and until (exclusive) are applied over created_at,
+// sort could be one of created, updated, key, size and order asc or desc.
+func parseListFilter(r *http.Request) (*listFilter, error) {
+	tags, err := parseTagFilters(r)
+	if err != nil {
+		return nil, err
+	}
+	f := &listFilter{Tags: tags}
+	getStringQueryParam(&f.Prefix, r, "prefix")
+	getStringQueryParam(&f.Since, r, "since")
+	getStringQueryParam(&f.Until, r, "until")
+	getStringQueryParam(&f.Sort, r, "sort")
+	getStringQueryParam(&f.Order, r, "order")
+
+	if f.Since != "" {
+		if f.Since, err = parseTime(f.Since); err != nil {
+			return nil, err
+		}
+	}
+	if f.Until != "" {
+		if f.Until, err = parseTime(f.Until); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := sortColumns[f.Sort]; f.Sort != "" && !ok {
+		return nil, fmt.Errorf("bad sort %q", f.Sort)
+	}
+	f.Order = strings.ToLower(f.Order)
+	if f.Order != "" && f.Order != "asc" && f.Order != "desc" {
+		return nil, fmt.Errorf("bad order %q", f.Order)
+	}
+	return f, nil
+}
+
+// globEscape escapes the special chars of a GLOB pattern.
+// GLOB is used instead of LIKE because it's case sensitive
+// and it can use the primary key index for prefixes.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[':
+			b.WriteString("[" + string(c) + "]")
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// where build the WHERE clause (empty if there is nothing to filter)
+// and its arguments.
+func (f *listFilter) where() (string, []interface{}) {
+	conds := []string{}
+	args := []interface{}{}
+	if f.Prefix != "" {
+		conds = append(conds, "data_id GLOB ?")
+		args = append(args, globEscape(f.Prefix)+"*")
+	}
+	for k, v := range f.Tags {
+		conds = append(conds, "data_id IN (SELECT data_id FROM tags WHERE name = ? AND value = ?)")
+		args = append(args, k, v)
+	}
+	if f.Since != "" {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, f.Since)
+	}
+	if f.Until != "" {
+		conds = append(conds, "created_at < ?")
+		args = append(args, f.Until)
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// orderBy build the ORDER BY clause, sort and order are used when
+// the request doesn't provide them. data_id is added to keep the
+// pagination stable between rows with the same value.
+func (f *listFilter) orderBy(sort, order string) string {
+	col, order := f.sortBy(sort, order)
+	if col == "data_id" {
+		return fmt.Sprintf(" ORDER BY data_id %s", order)
+	}
+	return fmt.Sprintf(" ORDER BY %s %s, data_id %s", col, order, order)
+}
+
+// sortBy the column and order requested, or the defaults
+func (f *listFilter) sortBy(sort, order string) (string, string) {
+	if f.Sort != "" {
+		sort = f.Sort
+	}
+	if f.Order != "" {
+		order = f.Order
+	}
+	return sortColumns[sort], order
+}
+
+// less compares rows in the same order as orderBy
+func (f *listFilter) less(sort, order string) func(a, b *DataID) bool {
+	col, order := f.sortBy(sort, order)
+	return func(a, b *DataID) bool {
+		c := 0
+		switch col {
+		case "created_at":
+			c = strings.Compare(a.CreatedAt, b.CreatedAt)
+		case "updated_at":
+			c = strings.Compare(a.UpdatedAt, b.UpdatedAt)
+		case "size":
+			if a.Size < b.Size {
+				c = -1
+			} else if a.Size > b.Size {
+				c = 1
+			}
+		}
+		if c == 0 {
+			c = strings.Compare(a.DataID, b.DataID)
+		}
+		if order == "desc" {
+			return c > 0
+		}
+		return c < 0
+	}
+}
+
+/*
+listPage the page of objects matched by the filter in the files of a
+namespace, the file of each object and the total. With more than one
+file (partitions) each one is read up to the end of the page and
+the rows are merged, so deep pages are more expensive.
+*/
+func listPage(ctx context.Context, dbs []*store.DB, f *listFilter, defSort, defOrder string, limit, offset int) ([]DataID, []*store.DB, int, error) {
+	where, args := f.where()
+	rows := []DataID{}
+	owners := []*store.DB{}
+	total := 0
+	for _, db := range dbs {
+		var n int
+		err := db.GetContext(ctx, &n, "SELECT count(*) FROM data"+where, args...)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		total += n
+
+		lim, off := limit, offset
+		if len(dbs) > 1 {
+			lim, off = offset+limit, 0
+		}
+		page := []DataID{}
+		err = db.SelectContext(ctx, &page, "SELECT data_id, created_at, updated_at, size FROM data"+
+			where+f.orderBy(defSort, defOrder)+" LIMIT ? OFFSET ?", append(args, lim, off)...)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		rows = append(rows, page...)
+		for range page {
+			owners = append(owners, db)
+		}
+	}
+	if len(dbs) == 1 {
+		return rows, owners, total, nil
+	}
+
+	less := f.less(defSort, defOrder)
+	idx := make([]int, len(rows))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, k int) bool {
+		return less(&rows[idx[i]], &rows[idx[k]])
+	})
+	resRows := []DataID{}
+	resOwners := []*store.DB{}
+	for i := offset; i < len(idx) && i < offset+limit; i++ {
+		resRows = append(resRows, rows[idx[i]])
+		resOwners = append(resOwners, owners[idx[i]])
+	}
+	return resRows, resOwners, total, nil
+}
+
+// byDB groups the keys of a page by the file where they are
+func byDB(rows []DataID, owners []*store.DB) map[*store.DB][]string {
+	res := map[*store.DB][]string{}
+	for i, r := range rows {
+		res[owners[i]] = append(res[owners[i]], r.DataID)
+	}
+	return res
+}
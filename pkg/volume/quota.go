@@ -0,0 +1,213 @@
+package volume
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	// ErrQuotaExceeded the namespace is out of objects or bytes
+	ErrQuotaExceeded = errors.New("namespace quota exceeded")
+	// ErrObjectTooLarge the object is bigger than the max object size
+	ErrObjectTooLarge = errors.New("object too large")
+)
+
+/*
+Quota limits of a namespace, zero means unlimited.
+MaxBytes is measured over the stored (compressed) data and
+MaxObjectSize over the data sent by the client.
+*/
+type Quota struct {
+	MaxObjects    int64 `json:"maxObjects"`
+	MaxBytes      int64 `json:"maxBytes"`
+	MaxObjectSize int64 `json:"maxObjectSize"`
+}
+
+// Usage current usage of a namespace, it's updated by triggers on each write.
+type Usage struct {
+	Objects int64 `db:"objects" json:"objects"`
+	Bytes   int64 `db:"bytes" json:"bytes"`
+}
+
+// QuotaResponse quota and usage of a namespace
+type QuotaResponse struct {
+	Namespace string `json:"namespace"`
+	Quota     *Quota `json:"quota"`
+	Usage     *Usage `json:"usage"`
+}
+
+// getQuota of a namespace, an empty quota is returned if it isn't defined
+func getQuota(ctx context.Context, db sqlx.QueryerContext) (*Quota, error) {
+	q := &Quota{}
+	_, err := getSetting(ctx, db, "quota", q)
+	return q, err
+}
+
+func getUsage(ctx context.Context, db sqlx.QueryerContext) (*Usage, error) {
+	u := &Usage{}
+	err := sqlx.GetContext(ctx, db, u, "SELECT objects, bytes FROM usage WHERE id = 1")
+	if errors.Is(err, sql.ErrNoRows) {
+		return u, nil
+	}
+	return u, err
+}
+
+// plus usage with o added, o can be nil
+func (u *Usage) plus(o *Usage) *Usage {
+	if o == nil {
+		return u
+	}
+	return &Usage{Objects: u.Objects + o.Objects, Bytes: u.Bytes + o.Bytes}
+}
+
+/*
+otherUsage usage of the files of a namespace but db, the quota of a
+partitioned namespace applies to all its files together. A version of key
+kept in another file is not counted, it's deleted once the new one is written.
+*/
+func (wa *WebApp) otherUsage(ctx context.Context, ns string, db *store.DB, key string) (*Usage, error) {
+	total := &Usage{}
+	for _, other := range wa.nsDBs(ns) {
+		if other == db {
+			continue
+		}
+		u, err := getUsage(ctx, other)
+		if err != nil {
+			return nil, err
+		}
+		var prev sql.NullInt64
+		err = other.GetContext(ctx, &prev, "SELECT length(data) FROM data WHERE data_id = ?", key)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		if prev.Valid {
+			u.Objects--
+			u.Bytes -= prev.Int64
+		}
+		total = total.plus(u)
+	}
+	return total, nil
+}
+
+// checkQuota verifies inside the write transaction that storing
+// stored bytes under key doesn't exceed the limits of the namespace,
+// others is the usage of the other files of the namespace.
+func checkQuota(ctx context.Context, tx *sqlx.Tx, key string, stored int64, others *Usage) error {
+	q, err := getQuota(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if q.MaxObjects == 0 && q.MaxBytes == 0 {
+		return nil
+	}
+	u, err := getUsage(ctx, tx)
+	if err != nil {
+		return err
+	}
+	u = u.plus(others)
+
+	var prev sql.NullInt64
+	err = tx.GetContext(ctx, &prev, "SELECT length(data) FROM data WHERE data_id = ?", key)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if q.MaxObjects > 0 && !prev.Valid && u.Objects+1 > q.MaxObjects {
+		return ErrQuotaExceeded
+	}
+	if q.MaxBytes > 0 && u.Bytes-prev.Int64+stored > q.MaxBytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// checkBytes verifies that n more stored bytes fit in the namespace
+func checkBytes(ctx context.Context, tx *sqlx.Tx, n int64, others *Usage) error {
+	q, err := getQuota(ctx, tx)
+	if err != nil || q.MaxBytes == 0 {
+		return err
+	}
+	u, err := getUsage(ctx, tx)
+	if err != nil {
+		return err
+	}
+	u = u.plus(others)
+	if u.Bytes+n > q.MaxBytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// quotaStatus http status for quota errors, 0 if the error isn't related
+func quotaStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrObjectTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	}
+	return 0
+}
+
+// GetQuota returns the quota and the current usage of a namespace
+func (wa *WebApp) GetQuota(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	db, ok := wa.nsDB(ns)
+	if !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	q, err := getQuota(r.Context(), db)
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	u, err := getUsage(r.Context(), db)
+	if err == nil {
+		var others *Usage
+		others, err = wa.otherUsage(r.Context(), ns, db, "")
+		u = u.plus(others)
+	}
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	wa.render.JSON(w, http.StatusOK, &QuotaResponse{Namespace: ns, Quota: q, Usage: u})
+}
+
+// PutQuota changes the limits of a namespace
+func (wa *WebApp) PutQuota(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	if _, ok := wa.nsDB(ns); !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var q Quota
+	if err := json.Unmarshal(b, &q); err != nil {
+		wa.render.JSON(w, http.StatusBadRequest,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	if err := wa.putNSSetting(r.Context(), ns, "quota", &q); err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	wa.GetQuota(w, r)
+}
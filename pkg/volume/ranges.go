@@ -0,0 +1,80 @@
+package volume
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+/*
+zlibReader io.ReadSeeker over an object compressed inline.
+zlib streams can't be accessed randomly, so seeking forward
+decompresses and discards up to the offset, and seeking backwards
+starts again from the beginning. http.ServeContent only seeks
+forward for each range (after sniffing the content type).
+*/
+type zlibReader struct {
+	blob []byte
+	size int64
+	pos  int64
+	zr   io.ReadCloser
+	// zpos position of zr in the decompressed stream
+	zpos int64
+}
+
+func newZlibReader(blob []byte, size int64) *zlibReader {
+	return &zlibReader{blob: blob, size: size}
+}
+
+func (z *zlibReader) reset() error {
+	zr, err := zlib.NewReader(bytes.NewReader(z.blob))
+	if err != nil {
+		return err
+	}
+	z.zr = zr
+	z.zpos = 0
+	return nil
+}
+
+func (z *zlibReader) Read(p []byte) (int, error) {
+	if z.pos >= z.size {
+		return 0, io.EOF
+	}
+	if z.zr == nil || z.zpos > z.pos {
+		if err := z.reset(); err != nil {
+			return 0, err
+		}
+	}
+	if z.zpos < z.pos {
+		n, err := io.CopyN(ioutil.Discard, z.zr, z.pos-z.zpos)
+		z.zpos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := z.zr.Read(p)
+	z.zpos += int64(n)
+	z.pos += int64(n)
+	return n, err
+}
+
+func (z *zlibReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = z.pos + offset
+	case io.SeekEnd:
+		pos = z.size + offset
+	default:
+		return 0, errors.New("zlibReader.Seek: invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("zlibReader.Seek: negative position")
+	}
+	z.pos = pos
+	return pos, nil
+}
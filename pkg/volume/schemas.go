@@ -1,5 +1,15 @@
 package volume
 
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/jmoiron/sqlx"
+)
+
 var dataSchemaV1 = `
 CREATE TABLE IF NOT EXISTS data (
 	data_id    TEXT PRIMARY KEY,
@@ -9,4 +19,301 @@ CREATE TABLE IF NOT EXISTS data (
 
 -- CREATE INDEX  IF NOT EXISTS groupby_ix ON data(group_by);
 CREATE INDEX  IF NOT EXISTS created_ix ON data(created_at);
+
+CREATE TABLE IF NOT EXISTS tags (
+	data_id    TEXT NOT NULL,
+	name       TEXT NOT NULL,
+	value      TEXT NOT NULL,
+	PRIMARY KEY (data_id, name)
+);
+
+CREATE INDEX  IF NOT EXISTS tags_ix ON tags(name, value);
 `
+
+// migration changes the schema of a namespace from one version to the next.
+type migration func(tx *sqlx.Tx) error
+
+/*
+migrations are applied in order after dataSchemaV1, the version
+of each sqlite file is stored with PRAGMA user_version.
+So a file with user_version=1 already has migrations[0].
+*/
+var migrations = []migration{
+	migrateV2,
+	migrateV3,
+	migrateV4,
+	migrateV5,
+	migrateV6,
+	migrateV7,
+	migrateV8,
+	migrateV9,
+}
+
+// migrateV2 adds updated_at and the uncompressed size of each object
+func migrateV2(tx *sqlx.Tx) error {
+	stmts := []string{
+		"ALTER TABLE data ADD COLUMN updated_at TEXT",
+		"ALTER TABLE data ADD COLUMN size INTEGER NOT NULL DEFAULT 0",
+		"UPDATE data SET updated_at = created_at",
+		"CREATE INDEX IF NOT EXISTS updated_ix ON data(updated_at)",
+		"CREATE INDEX IF NOT EXISTS size_ix ON data(size)",
+	}
+	for _, s := range stmts {
+		if _, err := tx.Exec(s); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Queryx("SELECT data_id, data FROM data")
+	if err != nil {
+		return err
+	}
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var key string
+		var blob []byte
+		if err := rows.Scan(&key, &blob); err != nil {
+			rows.Close()
+			return err
+		}
+		sizes[key] = int64(len(blob))
+		if zr, err := zlib.NewReader(bytes.NewReader(blob)); err == nil {
+			if n, err := io.Copy(ioutil.Discard, zr); err == nil {
+				sizes[key] = n
+			}
+		}
+	}
+	rows.Close()
+	for k, s := range sizes {
+		if _, err := tx.Exec("UPDATE data SET size = ? WHERE data_id = ?", s, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateV3 adds the settings of the namespace and the usage counters,
+// usage is updated by triggers in the same transaction of each write.
+func migrateV3(tx *sqlx.Tx) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS settings (
+			name  TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS usage (
+			id      INTEGER PRIMARY KEY CHECK (id = 1),
+			objects INTEGER NOT NULL DEFAULT 0,
+			bytes   INTEGER NOT NULL DEFAULT 0
+		)`,
+		`INSERT OR REPLACE INTO usage (id, objects, bytes)
+			SELECT 1, count(*), coalesce(sum(length(data)), 0) FROM data`,
+		`CREATE TRIGGER IF NOT EXISTS usage_insert AFTER INSERT ON data BEGIN
+			UPDATE usage SET objects = objects + 1, bytes = bytes + length(NEW.data) WHERE id = 1;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS usage_delete AFTER DELETE ON data BEGIN
+			UPDATE usage SET objects = objects - 1, bytes = bytes - length(OLD.data) WHERE id = 1;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS usage_update AFTER UPDATE OF data ON data BEGIN
+			UPDATE usage SET bytes = bytes - length(OLD.data) + length(NEW.data) WHERE id = 1;
+		END`,
+	}
+	for _, s := range stmts {
+		if _, err := tx.Exec(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateV4 adds the chunks of big objects, chunk_size is 0 when
+// the object is stored inline in the data table.
+func migrateV4(tx *sqlx.Tx) error {
+	stmts := []string{
+		"ALTER TABLE data ADD COLUMN chunk_size INTEGER NOT NULL DEFAULT 0",
+		`CREATE TABLE IF NOT EXISTS chunks (
+			data_id TEXT NOT NULL,
+			seq     INTEGER NOT NULL,
+			data    BLOB NOT NULL,
+			PRIMARY KEY (data_id, seq)
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS usage_chunk_insert AFTER INSERT ON chunks BEGIN
+			UPDATE usage SET bytes = bytes + length(NEW.data) WHERE id = 1;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS usage_chunk_delete AFTER DELETE ON chunks BEGIN
+			UPDATE usage SET bytes = bytes - length(OLD.data) WHERE id = 1;
+		END`,
+	}
+	for _, s := range stmts {
+		if _, err := tx.Exec(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateV5 adds the checksum of each object and the blobs shared by
+// deduplicated objects. The references of each blob are counted by triggers
+// and blobs without references are removed with its chunks.
+func migrateV5(tx *sqlx.Tx) error {
+	stmts := []string{
+		"ALTER TABLE data ADD COLUMN checksum TEXT",
+		"ALTER TABLE data ADD COLUMN dedup INTEGER NOT NULL DEFAULT 0",
+		"CREATE INDEX IF NOT EXISTS checksum_ix ON data(checksum)",
+		`CREATE TABLE IF NOT EXISTS blobs (
+			hash       TEXT PRIMARY KEY,
+			data       BLOB NOT NULL,
+			chunk_size INTEGER NOT NULL DEFAULT 0,
+			refs       INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS blobs_ref AFTER INSERT ON data WHEN NEW.dedup = 1 BEGIN
+			UPDATE blobs SET refs = refs + 1 WHERE hash = NEW.checksum;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS blobs_unref AFTER DELETE ON data WHEN OLD.dedup = 1 BEGIN
+			UPDATE blobs SET refs = refs - 1 WHERE hash = OLD.checksum;
+			DELETE FROM blobs WHERE hash = OLD.checksum AND refs <= 0;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS blobs_reref AFTER UPDATE OF checksum, dedup ON data BEGIN
+			UPDATE blobs SET refs = refs + 1 WHERE NEW.dedup = 1 AND hash = NEW.checksum;
+			UPDATE blobs SET refs = refs - 1 WHERE OLD.dedup = 1 AND hash = OLD.checksum;
+			DELETE FROM blobs WHERE OLD.dedup = 1 AND hash = OLD.checksum AND refs <= 0;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS blobs_gc AFTER DELETE ON blobs BEGIN
+			DELETE FROM chunks WHERE data_id = '` + blobPrefix + `' || OLD.hash;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS usage_blob_insert AFTER INSERT ON blobs BEGIN
+			UPDATE usage SET bytes = bytes + length(NEW.data) WHERE id = 1;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS usage_blob_delete AFTER DELETE ON blobs BEGIN
+			UPDATE usage SET bytes = bytes - length(OLD.data) WHERE id = 1;
+		END`,
+	}
+	for _, s := range stmts {
+		if _, err := tx.Exec(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateV6 adds the quarantine of objects which failed a check, their
+// chunks are kept under the quarantine prefix.
+func migrateV6(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS quarantine (
+		data_id        TEXT PRIMARY KEY,
+		data           BLOB NOT NULL,
+		created_at     TEXT,
+		size           INTEGER NOT NULL DEFAULT 0,
+		chunk_size     INTEGER NOT NULL DEFAULT 0,
+		checksum       TEXT,
+		reason         TEXT NOT NULL,
+		quarantined_at TEXT DEFAULT CURRENT_TIMESTAMP
+	)`)
+	return err
+}
+
+// migrateV7 adds the outbox, the change events are written in the same
+// transaction as the objects and sent to the stream by the relay.
+func migrateV7(tx *sqlx.Tx) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS outbox (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			event      TEXT NOT NULL,
+			attempts   INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			next_at    TEXT DEFAULT CURRENT_TIMESTAMP,
+			sent_at    TEXT
+		)`,
+		"CREATE INDEX IF NOT EXISTS outbox_pending_ix ON outbox(id) WHERE sent_at IS NULL",
+	}
+	for _, s := range stmts {
+		if _, err := tx.Exec(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateV8 adds the changelog of the file, seq is given by the volume so
+// it's increasing across the partitions of a namespace.
+func migrateV8(tx *sqlx.Tx) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS changes (
+			seq        INTEGER PRIMARY KEY,
+			type       TEXT NOT NULL,
+			data_id    TEXT NOT NULL,
+			size       INTEGER NOT NULL DEFAULT 0,
+			checksum   TEXT,
+			request_id TEXT,
+			created_at TEXT NOT NULL
+		)`,
+		"CREATE INDEX IF NOT EXISTS changes_created_ix ON changes(created_at)",
+	}
+	for _, s := range stmts {
+		if _, err := tx.Exec(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateV9 adds the webhooks of the namespace, each one with the seq of
+// the last change delivered, and the deliveries which failed too many times.
+func migrateV9(tx *sqlx.Tx) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS hooks (
+			id         TEXT PRIMARY KEY,
+			url        TEXT NOT NULL,
+			secret     TEXT NOT NULL,
+			prefix     TEXT NOT NULL DEFAULT '',
+			events     TEXT NOT NULL DEFAULT '',
+			cursor     INTEGER NOT NULL DEFAULT 0,
+			attempts   INTEGER NOT NULL DEFAULT 0,
+			next_at    TEXT,
+			last_error TEXT,
+			created_at TEXT DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS hook_dead (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			hook_id    TEXT NOT NULL,
+			seq        INTEGER NOT NULL,
+			event      TEXT NOT NULL,
+			attempts   INTEGER NOT NULL,
+			last_error TEXT,
+			failed_at  TEXT DEFAULT CURRENT_TIMESTAMP
+		)`,
+		"CREATE INDEX IF NOT EXISTS hook_dead_hook_ix ON hook_dead(hook_id)",
+	}
+	for _, s := range stmts {
+		if _, err := tx.Exec(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate brings the schema of a namespace to the last version
+func migrate(db *sqlx.DB) error {
+	var version int
+	if err := db.Get(&version, "PRAGMA user_version"); err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+		if err := migrations[i](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		// PRAGMA doesn't accept bind parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
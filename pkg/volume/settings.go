@@ -0,0 +1,99 @@
+package volume
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// getSetting reads a setting of the namespace stored as json into v,
+// returns false if the setting doesn't exist.
+func getSetting(ctx context.Context, db sqlx.QueryerContext, name string, v interface{}) (bool, error) {
+	var value string
+	err := sqlx.GetContext(ctx, db, &value, "SELECT value FROM settings WHERE name = ?", name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal([]byte(value), v)
+}
+
+// putSetting stores v as json in the settings of the namespace
+func putSetting(ctx context.Context, db sqlx.ExecerContext, name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx,
+		"INSERT INTO settings (name, value) VALUES ($1, $2) ON CONFLICT(name) DO UPDATE SET value=$2",
+		name, string(b))
+	return err
+}
+
+// SQLiteSettingsResponse sqlite settings of a namespace
+type SQLiteSettingsResponse struct {
+	Namespace string               `json:"namespace"`
+	Settings  *store.SQLiteOptions `json:"settings"`
+	Effective *store.SQLiteOptions `json:"effective"`
+}
+
+// GetSQLiteSettings returns the sqlite settings of the namespace and
+// the result of merging them with the global settings.
+func (wa *WebApp) GetSQLiteSettings(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	db, ok := wa.nsDB(ns)
+	if !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	opts := &store.SQLiteOptions{}
+	if _, err := getSetting(r.Context(), db, "sqlite", opts); err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	wa.render.JSON(w, http.StatusOK, &SQLiteSettingsResponse{
+		Namespace: ns,
+		Settings:  opts,
+		Effective: wa.cfg.sqliteOptions().Merge(opts),
+	})
+}
+
+// PutSQLiteSettings stores the sqlite settings of a namespace,
+// they are applied the next time the namespace is opened.
+func (wa *WebApp) PutSQLiteSettings(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	db, ok := wa.nsDB(ns)
+	if !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var opts store.SQLiteOptions
+	if err := json.Unmarshal(b, &opts); err != nil {
+		wa.render.JSON(w, http.StatusBadRequest,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	if err := putSetting(r.Context(), db.W, "sqlite", &opts); err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	wa.GetSQLiteSettings(w, r)
+}
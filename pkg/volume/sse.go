@@ -0,0 +1,114 @@
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// sseHeartbeat a comment is sent this often, so proxies keep the
+// connection open and dead clients are detected.
+var sseHeartbeat = 15 * time.Second
+
+/*
+Events pushes the changes of a namespace as Server-Sent Events. The id of
+each event is its seq in the changelog, so a client which reconnects with
+Last-Event-ID (or ?since=) receives the changes it missed, without it only
+the new changes are sent. With ?prefix= only the keys with the prefix are sent.
+*/
+func (wa *WebApp) Events(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	if _, ok := wa.nsDB(ns); !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	cl := wa.changelog(ns)
+	if cl == nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": "changelog not available"})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": "streaming not supported"})
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	since := cl.stable()
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = r.URL.Query().Get("since")
+	}
+	if resume != "" {
+		var err error
+		if since, err = strconv.ParseInt(resume, 10, 64); err != nil || since < 0 {
+			wa.render.JSON(w, http.StatusBadRequest,
+				map[string]string{"error": fmt.Sprintf("bad event id %q", resume)})
+			return
+		}
+		if pruned := cl.prunedSeq(); since < pruned {
+			wa.render.JSON(w, http.StatusGone,
+				map[string]string{"error": fmt.Sprintf("changes up to %d were pruned", pruned)})
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// nginx buffers the responses by default
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// the client reconnects with Last-Event-ID when the files are changed
+	drain := wa.draining(ns)
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		changed := cl.changed()
+		changes, err := wa.readChanges(r.Context(), ns, since, cl.stable(), changesMaxLimit)
+		if err != nil {
+			log.Printf("Error reading changes of %s: %s", ns, err)
+			return
+		}
+		for i := range changes {
+			c := &changes[i]
+			since = c.Seq
+			if !strings.HasPrefix(c.Key, prefix) {
+				continue
+			}
+			b, err := json.Marshal(c)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.Seq, c.Type, b); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		if len(changes) == changesMaxLimit {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-drain:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package volume
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/go-chi/chi/v5"
+)
+
+// NamespaceStats size and usage information of a namespace
+type NamespaceStats struct {
+	Namespace        string  `json:"namespace"`
+	Objects          int64   `json:"objects"`
+	RawBytes         int64   `json:"rawBytes"`
+	CompressedBytes  int64   `json:"compressedBytes"`
+	CompressionRatio float64 `json:"compressionRatio"`
+	Oldest           string  `json:"oldest,omitempty"`
+	Newest           string  `json:"newest,omitempty"`
+	FileSize         int64   `json:"fileSize"`
+	WALSize          int64   `json:"walSize"`
+	PageSize         int64   `json:"pageSize"`
+	PageCount        int64   `json:"pageCount"`
+	FreelistCount    int64   `json:"freelistCount"`
+	// AutoVacuum 0 NONE, 1 FULL, 2 INCREMENTAL
+	AutoVacuum int64 `json:"autoVacuum"`
+	// OutboxPending change events not sent to the stream yet
+	OutboxPending int64 `json:"outboxPending"`
+	// Writer metrics of the write queue since the namespace was opened
+	Writer *store.WriterStats `json:"writer,omitempty"`
+	// Partitions stats of each open partition, newest first
+	Partitions []*NamespaceStats `json:"partitions,omitempty"`
+}
+
+// NamespaceSummary short version of the stats included in /status
+type NamespaceSummary struct {
+	Objects int64 `json:"objects"`
+	// Bytes stored (compressed) bytes counted for the quota
+	Bytes      int64 `json:"bytes"`
+	FileSize   int64 `json:"fileSize"`
+	QueueDepth int   `json:"queueDepth"`
+	// Mode ro or archived, empty for writable namespaces
+	Mode string `json:"mode,omitempty"`
+	// Closed the namespace is opened on the next use, only
+	// the file size is reported
+	Closed bool `json:"closed,omitempty"`
+}
+
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// nsStats collects the stats of a namespace
+func (wa *WebApp) nsStats(ctx context.Context, ns string, db *store.DB) (*NamespaceStats, error) {
+	st := &NamespaceStats{Namespace: ns}
+	row := db.QueryRowxContext(ctx, `SELECT count(*), coalesce(sum(size), 0),
+		coalesce(sum(length(data)), 0), coalesce(min(created_at), ''), coalesce(max(created_at), '')
+		FROM data`)
+	err := row.Scan(&st.Objects, &st.RawBytes, &st.CompressedBytes, &st.Oldest, &st.Newest)
+	if err != nil {
+		return nil, err
+	}
+	// chunks of big objects and blobs shared by deduplicated objects
+	var chunked int64
+	err = db.GetContext(ctx, &chunked, `SELECT
+		(SELECT coalesce(sum(length(data)), 0) FROM chunks) +
+		(SELECT coalesce(sum(length(data)), 0) FROM blobs)`)
+	if err != nil {
+		return nil, err
+	}
+	st.CompressedBytes += chunked
+	if st.CompressedBytes > 0 {
+		st.CompressionRatio = float64(st.RawBytes) / float64(st.CompressedBytes)
+	}
+
+	pragmas := map[string]*int64{
+		"page_size":      &st.PageSize,
+		"page_count":     &st.PageCount,
+		"freelist_count": &st.FreelistCount,
+		"auto_vacuum":    &st.AutoVacuum,
+	}
+	for p, v := range pragmas {
+		if err := db.GetContext(ctx, v, "PRAGMA "+p); err != nil {
+			return nil, err
+		}
+	}
+
+	err = db.GetContext(ctx, &st.OutboxPending, "SELECT count(*) FROM outbox WHERE sent_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+
+	st.FileSize = fileSize(db.Path)
+	st.WALSize = fileSize(db.Path + "-wal")
+	if db.Writer != nil {
+		ws := db.Writer.Stats()
+		st.Writer = &ws
+	}
+	return st, nil
+}
+
+// nsSummary cheap stats of a namespace, including its partitions,
+// objects and bytes are read from the usage counters.
+func (wa *WebApp) nsSummary(ctx context.Context, ns string) *NamespaceSummary {
+	sum := &NamespaceSummary{}
+	if db, ok := wa.nsDB(ns); ok && db.ReadOnly {
+		if o, err := getOptions(ctx, db); err == nil {
+			sum.Mode = o.Mode
+		}
+	}
+	for _, db := range wa.nsDBs(ns) {
+		if u, err := getUsage(ctx, db); err == nil {
+			sum.Objects += u.Objects
+			sum.Bytes += u.Bytes
+		}
+		sum.FileSize += fileSize(db.Path)
+		if db.Writer != nil {
+			sum.QueueDepth += db.Writer.Stats().QueueDepth
+		}
+	}
+	return sum
+}
+
+// NSStats returns objects count, sizes and sqlite information of a namespace
+func (wa *WebApp) NSStats(w http.ResponseWriter, r *http.Request) {
+	ns := chi.URLParam(r, "ns")
+	db, ok := wa.nsDB(ns)
+	if !ok {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Namespace not found"})
+		return
+	}
+	st, err := wa.nsStats(r.Context(), ns, db)
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": err.Error()})
+		return
+	}
+	for _, pdb := range wa.nsDBs(ns) {
+		if pdb == db {
+			continue
+		}
+		pst, err := wa.nsStats(r.Context(), wa.fileLabel(ns, pdb), pdb)
+		if err != nil {
+			wa.render.JSON(w, http.StatusInternalServerError,
+				map[string]string{"error": err.Error()})
+			return
+		}
+		st.Partitions = append(st.Partitions, pst)
+	}
+	wa.render.JSON(w, http.StatusOK, st)
+}
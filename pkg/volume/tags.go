@@ -0,0 +1,206 @@
+package volume
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// TagHeaderPrefix every header starting with this prefix
+// is stored as a tag of the object, e.g. `X-RD-Tag-source: sitemap`
+const TagHeaderPrefix = "X-Rd-Tag-"
+
+// Tags key/value labels attached to an object
+type Tags map[string]string
+
+// tagsFromHeaders extract the tags sent as headers in a write request.
+// Tag names are case insensitive, so they are always stored in lowercase.
+func tagsFromHeaders(h http.Header) Tags {
+	tags := Tags{}
+	for k, v := range h {
+		ck := http.CanonicalHeaderKey(k)
+		if !strings.HasPrefix(ck, TagHeaderPrefix) || len(v) == 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(ck, TagHeaderPrefix))
+		if name == "" {
+			continue
+		}
+		tags[name] = v[0]
+	}
+	return tags
+}
+
+// writeTagHeaders add the tags of an object to the response headers
+func writeTagHeaders(h http.Header, tags Tags) {
+	for k, v := range tags {
+		h.Set(TagHeaderPrefix+k, v)
+	}
+}
+
+// setTags upsert tags of an object inside a transaction
+func setTags(ctx context.Context, tx *sqlx.Tx, key string, tags Tags) error {
+	for k, v := range tags {
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO tags (data_id, name, value) VALUES ($1, $2, $3) ON CONFLICT(data_id, name) DO UPDATE SET value=$3",
+			key, k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getTags get all the tags of one object
+func getTags(ctx context.Context, db sqlx.QueryerContext, key string) (Tags, error) {
+	rows := []struct {
+		Name  string `db:"name"`
+		Value string `db:"value"`
+	}{}
+	err := sqlx.SelectContext(ctx, db, &rows, "SELECT name, value FROM tags WHERE data_id = ?", key)
+	if err != nil {
+		return nil, err
+	}
+	tags := Tags{}
+	for _, r := range rows {
+		tags[r.Name] = r.Value
+	}
+	return tags, nil
+}
+
+// getTagsByKeys get the tags for a group of objects, indexed by key.
+func getTagsByKeys(ctx context.Context, db sqlx.QueryerContext, keys []string) (map[string]Tags, error) {
+	res := map[string]Tags{}
+	if len(keys) == 0 {
+		return res, nil
+	}
+	q, args, err := sqlx.In("SELECT data_id, name, value FROM tags WHERE data_id IN (?)", keys)
+	if err != nil {
+		return nil, err
+	}
+	rows := []struct {
+		DataID string `db:"data_id"`
+		Name   string `db:"name"`
+		Value  string `db:"value"`
+	}{}
+	err = sqlx.SelectContext(ctx, db, &rows, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		if _, ok := res[r.DataID]; !ok {
+			res[r.DataID] = Tags{}
+		}
+		res[r.DataID][r.Name] = r.Value
+	}
+	return res, nil
+}
+
+// parseTagFilters parse `tag=name:value` query params
+func parseTagFilters(r *http.Request) (Tags, error) {
+	tags := Tags{}
+	for _, t := range r.URL.Query()["tag"] {
+		kv := strings.SplitN(t, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("bad tag filter %q, expected name:value", t)
+		}
+		tags[strings.ToLower(kv[0])] = kv[1]
+	}
+	return tags, nil
+}
+
+// TagsResponse tags of one object
+type TagsResponse struct {
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+	Tags      Tags   `json:"tags"`
+}
+
+func dataExists(ctx context.Context, db sqlx.QueryerContext, key string) (bool, error) {
+	var n int
+	err := sqlx.GetContext(ctx, db, &n, "SELECT count(*) FROM data WHERE data_id = ?", key)
+	return n > 0, err
+}
+
+// GetTags get the tags of an object
+func (wa *WebApp) GetTags(w http.ResponseWriter, r *http.Request) {
+	dataPath := chi.URLParam(r, "data")
+	ns := chi.URLParam(r, "ns")
+
+	db, err := wa.findDB(r.Context(), ns, dataPath)
+	if err != nil || db == nil {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Data not found"})
+		return
+	}
+	tags, err := getTags(r.Context(), db, dataPath)
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	wa.render.JSON(w, http.StatusOK, &TagsResponse{Namespace: ns, Path: dataPath, Tags: tags})
+}
+
+// PutTags edit the tags of an object without touching the data.
+// With PUT the tags are replaced, with PATCH the tags are merged, and
+// a tag with an empty value is removed.
+func (wa *WebApp) PutTags(w http.ResponseWriter, r *http.Request) {
+	dataPath := chi.URLParam(r, "data")
+	ns := chi.URLParam(r, "ns")
+
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var tags Tags
+	if err := json.Unmarshal(b, &tags); err != nil {
+		wa.render.JSON(w, http.StatusBadRequest,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+
+	db, err := wa.findDB(r.Context(), ns, dataPath)
+	if err != nil || db == nil {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Data not found"})
+		return
+	}
+
+	err = db.Write(r.Context(), func(ctx context.Context, tx *sqlx.Tx) error {
+		if r.Method == http.MethodPut {
+			_, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE data_id = ?", dataPath)
+			if err != nil {
+				return err
+			}
+		}
+		set := Tags{}
+		for k, v := range tags {
+			k = strings.ToLower(k)
+			if v == "" {
+				_, err := tx.ExecContext(ctx,
+					"DELETE FROM tags WHERE data_id = ? AND name = ?", dataPath, k)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			set[k] = v
+		}
+		return setTags(ctx, tx, dataPath, set)
+	})
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+
+	current, _ := getTags(r.Context(), db, dataPath)
+	wa.render.JSON(w, http.StatusOK, &TagsResponse{Namespace: ns, Path: dataPath, Tags: current})
+}
@@ -0,0 +1,62 @@
+package volume
+
+import (
+	"io"
+	"math"
+	"net/http"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+)
+
+// limitedReader fails with ErrObjectTooLarge when more than n bytes
+// are read, n <= 0 means no limit.
+type limitedReader struct {
+	r    io.Reader
+	n    int64
+	read int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.n > 0 && l.read > l.n {
+		return n, ErrObjectTooLarge
+	}
+	return n, err
+}
+
+// bodyLimit the max size of an object for a namespace, the lower
+// between the max body size of the volume and the quota of the namespace.
+func (wa *WebApp) bodyLimit(quota *Quota) int64 {
+	limit := wa.cfg.MaxBodySize
+	if quota.MaxObjectSize > 0 && (limit <= 0 || quota.MaxObjectSize < limit) {
+		limit = quota.MaxObjectSize
+	}
+	return limit
+}
+
+// chunkSize objects bigger than this are stored in chunks
+func (c *Config) chunkSize() int64 {
+	if c.ChunkSize <= 0 {
+		return math.MaxInt64
+	}
+	return c.ChunkSize
+}
+
+// readBody streams the body of a write request of key through the compressor,
+// so only the compressed version is kept in memory, or for big objects
+// only the chunk being written.
+func (wa *WebApp) readBody(r *http.Request, ns, key string, db *store.DB, quota *Quota) (*Upload, error) {
+	limit := wa.bodyLimit(quota)
+	if limit > 0 && r.ContentLength > limit {
+		return nil, ErrObjectTooLarge
+	}
+	var others *Usage
+	if quota.MaxObjects > 0 || quota.MaxBytes > 0 {
+		var err error
+		if others, err = wa.otherUsage(r.Context(), ns, db, key); err != nil {
+			return nil, err
+		}
+	}
+	return readUpload(r.Context(), db, &limitedReader{r: r.Body, n: limit}, wa.cfg.chunkSize(), others)
+}
@@ -1,18 +1,18 @@
 package volume
 
 import (
-	"bytes"
-	"compress/zlib"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/algorinfo/rawstore/pkg/store"
 	"github.com/go-chi/chi/v5"
@@ -55,6 +55,26 @@ type Config struct {
 	Addr   string
 	NSDir  string
 	Stream bool
+	// MaxBodySize max size in bytes of an object, 0 means no limit
+	MaxBodySize int64
+	// MaxUploadSize max size in bytes of an uploaded namespace file,
+	// 0 means no limit
+	MaxUploadSize int64
+	// ChunkSize objects bigger than this are split in chunks, 0 disables it
+	ChunkSize int64
+	// SQLite global settings, each namespace could override them
+	SQLite *store.SQLiteOptions
+	// Writer limits of the group commits, nil uses the defaults
+	Writer *store.WriterOptions
+	// MaxOpenNS namespaces kept open, the least recently used are
+	// closed when it's exceeded, 0 means no limit
+	MaxOpenNS int
+	// IdleTimeout namespaces not used for this time are closed, 0 disables it
+	IdleTimeout time.Duration
+	// Watch registers the namespace files added or removed from NSDir
+	Watch bool
+	// ChangelogRetention changes older than this are removed, 0 keeps them
+	ChangelogRetention time.Duration
 	/*RedisAddress string
 	RedisPass    string
 	RedisDB      int*/
@@ -65,10 +85,26 @@ type WebApp struct {
 	r      *chi.Mux
 	render *render.Render
 	// redis      *store.Redis
-	dbs        map[string]*sqlx.DB
+	// mu guards dbs and parts
+	mu sync.RWMutex
+	// drained signaled when a reference on a busy namespace is released
+	drained    *sync.Cond
+	dbs        map[string]*nsHandle
+	parts      map[string]*partitions
 	namespaces []string
 	cfg        *Config
-	producer   *store.Producer
+	jobs       *Jobs
+	publisher  store.Publisher
+	// relayWake wakes up the relay of the outbox
+	relayWake chan struct{}
+	// relayed progress of the relay over the read-only files by path
+	relayMu sync.Mutex
+	relayed map[string]*relayState
+	// hookWake wakes up the delivery of the webhooks, the loop is
+	// started when the first namespace with hooks is found
+	hookWake  chan struct{}
+	hooksOnce sync.Once
+	hooksOn   int32
 }
 
 // RegisterRoutes Register routes for the router and docs
@@ -81,21 +117,59 @@ func (wa *WebApp) RegisterRoutes() {
 	wa.r.Get("/status", wa.Status)
 	wa.r.Route("/v1", func(r chi.Router) {
 		r.Get("/namespace", wa.AllNS)
-		r.Get("/namespace/{ns}/_backup", wa.NSBackup)
 		r.Post("/namespace", wa.CreateNS)
-		r.Get("/data/{ns}/_list", wa.GetIDData)
-		r.Get("/data/{ns}", wa.GetAllData)
+		// it replaces the namespace, so it doesn't hold it
+		r.With(wa.writable).Put("/namespace/{ns}/_upload", wa.Upload)
+		r.Get("/jobs", wa.AllJobs)
+		r.Get("/jobs/{id}", wa.GetJob)
+		r.Group(func(r chi.Router) {
+			r.Use(wa.holdNS)
+			r.Get("/namespace/{ns}/_backup", wa.NSBackup)
+			r.Get("/namespace/{ns}/_download", wa.Download)
+			r.Get("/namespace/{ns}/_events", wa.Events)
+			r.Get("/namespace/{ns}/_hooks", wa.AllHooks)
+			r.With(wa.writable).Post("/namespace/{ns}/_hooks", wa.CreateHook)
+			r.Get("/namespace/{ns}/_hooks/{id}", wa.GetHook)
+			r.With(wa.writable).Delete("/namespace/{ns}/_hooks/{id}", wa.DelHook)
+			r.Post("/namespace/{ns}/_hooks/{id}/_test", wa.TestHook)
+			r.Get("/namespace/{ns}/_hooks/{id}/dead", wa.DeadLetters)
+			r.With(wa.writable).Post("/namespace/{ns}/_hooks/{id}/dead/_retry", wa.RetryDeadLetters)
+			r.Get("/namespace/{ns}/stats", wa.NSStats)
+			r.Get("/namespace/{ns}/quota", wa.GetQuota)
+			r.With(wa.writable).Put("/namespace/{ns}/quota", wa.PutQuota)
+			r.Get("/namespace/{ns}/sqlite", wa.GetSQLiteSettings)
+			r.With(wa.writable).Put("/namespace/{ns}/sqlite", wa.PutSQLiteSettings)
+			r.With(wa.writable).Post("/namespace/{ns}/_compact", wa.Compact)
+			r.Post("/namespace/{ns}/_check", wa.Check)
+			r.Get("/namespace/{ns}/partitions", wa.AllPartitions)
+			r.With(wa.writable).Delete("/namespace/{ns}/partitions/{part}", wa.DropPartition)
+			r.With(wa.writable).Post("/namespace/{ns}/partitions/{part}/_archive", wa.DropPartition)
+			r.Get("/namespace/{ns}/options", wa.GetOptions)
+			r.Put("/namespace/{ns}/options", wa.PutOptions)
+			r.Get("/data/{ns}/_list", wa.GetIDData)
+			r.Get("/data/{ns}/_changes", wa.GetChanges)
+			r.With(wa.writable).Post("/data/{ns}/_delete", wa.BulkDelete)
+			r.Get("/data/{ns}/_tags/{data}", wa.GetTags)
+			r.With(wa.writable).Put("/data/{ns}/_tags/{data}", wa.PutTags)
+			r.With(wa.writable).Patch("/data/{ns}/_tags/{data}", wa.PutTags)
+			r.Get("/data/{ns}", wa.GetAllData)
+		})
 	})
 
-	workDir, _ := os.Getwd()
-	filesDir := http.Dir(filepath.Join(workDir, wa.cfg.NSDir))
-	FileServer(wa.r, "/files", filesDir)
-
-	wa.r.Put("/{ns}/{data}", wa.PutData)
-	wa.r.Post("/{ns}/{data}", wa.PostData)
-	wa.r.Get("/{ns}/{data}", wa.GetOneData)
-	wa.r.Delete("/{ns}/{data}", wa.DelOneData)
-	wa.r.Get("/{ns}", wa.GetAllData)
+	FileServer(wa.r, "/files", nsFiles{cfg: wa.cfg})
+
+	wa.r.Group(func(r chi.Router) {
+		r.Use(wa.holdNS)
+		// the live files of the namespaces are not served, they could be torn
+		r.Get("/files/{ns}.db", wa.Download)
+		r.Get("/files/{ns}/{part}.db", wa.Download)
+		r.With(wa.writable).Put("/{ns}/{data}", wa.PutData)
+		r.With(wa.writable).Post("/{ns}/{data}", wa.PostData)
+		r.Get("/{ns}/{data}", wa.GetOneData)
+		r.Head("/{ns}/{data}", wa.GetOneData)
+		r.With(wa.writable).Delete("/{ns}/{data}", wa.DelOneData)
+		r.Get("/{ns}", wa.GetAllData)
+	})
 	log.Println("Running web mode on: ", wa.cfg.Addr)
 	// http.ListenAndServe(wa.cfg.Addr, wa.r)
 }
@@ -141,8 +215,16 @@ type DataModel struct {
 	DataID string `db:"data_id" json:"dataID"`
 	Data   []byte `db:"data" json:"data"`
 	// GroupBy   sql.NullString `db:"group_by"`
-	// Checksum  sql.NullString `db:"checksum"`
 	CreatedAt string `db:"created_at" json:"createdAt"`
+	UpdatedAt string `db:"updated_at" json:"updatedAt"`
+	Size      int64  `db:"size" json:"size"`
+	// ChunkSize is 0 for objects stored inline in Data
+	ChunkSize int64 `db:"chunk_size" json:"chunkSize,omitempty"`
+	// Checksum sha256 of the data, empty for objects written before v5
+	Checksum string `db:"checksum" json:"checksum,omitempty"`
+	// Dedup the content is shared with other objects
+	Dedup bool `db:"dedup" json:"-"`
+	Tags  Tags `db:"-" json:"tags,omitempty"`
 }
 
 /*
@@ -150,16 +232,20 @@ Namespace Right now is a thin wrapper. In the future
 it could have other annotations.
 */
 type Namespace struct {
-	Name        string `json:"name"`
-	Stream      bool   `json:"stream,omitempty"`
-	StreamLimit int    `json:"stream_limit,omitempty"`
+	Name        string               `json:"name"`
+	Stream      bool                 `json:"stream,omitempty"`
+	StreamLimit int                  `json:"stream_limit,omitempty"`
+	Quota       *Quota               `json:"quota,omitempty"`
+	SQLite      *store.SQLiteOptions `json:"sqlite,omitempty"`
+	Options     *NSOptions           `json:"options,omitempty"`
 }
 
 type StatusResponse struct {
-	Stream         bool     `json:"stream"`
-	StreamLimit    int64    `json:"streamLimit,string"`
-	RedisNamespace string   `json:"redisNamespace"`
-	Namespaces     []string `json:"namespaces"`
+	Stream         bool                         `json:"stream"`
+	StreamLimit    int64                        `json:"streamLimit,string"`
+	RedisNamespace string                       `json:"redisNamespace"`
+	Namespaces     []string                     `json:"namespaces"`
+	Summary        map[string]*NamespaceSummary `json:"summary"`
 }
 
 // NSBackup, endpoint to start a backup in place of a namespace
@@ -168,16 +254,42 @@ func (wa *WebApp) Status(w http.ResponseWriter, r *http.Request) {
 	stream := false
 	streamLimit = 0
 	redisNs := "default"
-	if wa.producer != nil {
+	if wa.publisher != nil {
 		stream = true
-		streamLimit = wa.producer.MaxLenApprox
-		redisNs = wa.producer.Namespace
+	}
+	if p, ok := wa.publisher.(*store.Producer); ok {
+		streamLimit = p.MaxLenApprox
+		redisNs = p.Namespace
 	}
 	sr := &StatusResponse{
 		Stream:         stream,
 		StreamLimit:    streamLimit,
 		RedisNamespace: redisNs,
-		Namespaces:     wa.namespaces,
+		Namespaces:     wa.nsNames(),
+		Summary:        map[string]*NamespaceSummary{},
+	}
+	wa.mu.RLock()
+	closed := map[string]*NamespaceSummary{}
+	for ns, h := range wa.dbs {
+		if h.db == nil {
+			closed[ns] = &NamespaceSummary{Closed: true}
+			if h.archived {
+				closed[ns].Mode = ModeArchived
+			}
+		}
+	}
+	wa.mu.RUnlock()
+	for _, ns := range sr.Namespaces {
+		if sum, ok := closed[ns]; ok {
+			// closed namespaces are not opened for the status
+			sum.FileSize = fileSize(wa.nsFile(ns) + ".db")
+			sr.Summary[ns] = sum
+			continue
+		}
+		if h := wa.acquire(ns); h != nil {
+			sr.Summary[ns] = wa.nsSummary(r.Context(), ns)
+			wa.release(h)
+		}
 	}
 
 	wa.render.JSON(w, http.StatusOK, sr)
@@ -210,40 +322,144 @@ func (wa *WebApp) CreateNS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, ok := wa.dbs[ns.Name]; ok {
-		wa.render.JSON(w, http.StatusOK, &wa.namespaces)
+	if err := validNSName(ns.Name); err != nil {
+		wa.render.JSON(w, http.StatusBadRequest,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	if _, ok := wa.nsDB(ns.Name); ok {
+		wa.render.JSON(w, http.StatusOK, wa.nsNames())
+		return
+	}
+	if ns.Options != nil {
+		if err := ns.Options.validate(); err != nil {
+			wa.render.JSON(w, http.StatusBadRequest,
+				map[string]string{"error": fmt.Sprintf("%s", err)})
+			return
+		}
+	}
+	if err := CreateNS(wa, dataSchemaV1, ns.Name); err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	db, ok := wa.nsDB(ns.Name)
+	if !ok {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("namespace %s could not be opened", ns.Name)})
 		return
 	}
-	CreateNS(wa, dataSchemaV1, ns.Name)
+	if ns.Quota != nil {
+		if err := putSetting(r.Context(), db.W, "quota", ns.Quota); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	if ns.SQLite != nil {
+		if err := putSetting(r.Context(), db.W, "sqlite", ns.SQLite); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	if ns.Options != nil && locked(ns.Options.Mode) {
+		// the file is opened again in the new mode
+		h := wa.acquire(ns.Name)
+		if h == nil {
+			http.Error(w, "namespace not found", 500)
+			return
+		}
+		err := wa.setMode(r.Context(), ns.Name, ns.Options)
+		wa.release(h)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	} else {
+		if ns.Options != nil {
+			if err := putSetting(r.Context(), db.W, "options", ns.Options); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		if ns.SQLite != nil {
+			// nobody is using the namespace yet, so it's safe to open it again
+			wa.mu.Lock()
+			wa.closeNS(ns.Name, wa.dbs[ns.Name])
+			wa.mu.Unlock()
+		}
+	}
 
-	wa.render.JSON(w, http.StatusCreated, &wa.namespaces)
+	wa.render.JSON(w, http.StatusCreated, wa.nsNames())
 
 }
 
 // AllNS list all namespaces
 func (wa *WebApp) AllNS(w http.ResponseWriter, r *http.Request) {
 
-	wa.render.JSON(w, http.StatusOK, &wa.namespaces)
+	wa.render.JSON(w, http.StatusOK, wa.nsNames())
 }
 
-// InsertData insert data in the store
-func (wa *WebApp) InsertData(ctx context.Context, key, ns string, data []byte) error {
-	// wa.dbs[ns].Exec("INSERT INTO data(data_id, data, )")
-	_, err := wa.dbs[ns].ExecContext(ctx, "INSERT INTO data (data_id, data) VALUES ($1, $2)", key, data)
-	if err != nil {
-		return err
-	}
-	return nil
+// InsertData insert data and its tags in the store
+func (wa *WebApp) InsertData(ctx context.Context, ns string, db *store.DB, key string, up *Upload, tags Tags) error {
+	rec := wa.recorder(ctx, ns)
+	defer rec.done()
+	return db.Write(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		up, err := prepareObject(ctx, tx, key, up)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO data (data_id, data, size, chunk_size, checksum, dedup, updated_at) VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP)",
+			key, up.Data, up.Size, up.ChunkSize, up.Checksum, up.dedup)
+		if err != nil {
+			return err
+		}
+		if err := up.commitChunks(ctx, tx, key); err != nil {
+			return err
+		}
+		if err := setTags(ctx, tx, key, tags); err != nil {
+			return err
+		}
+		return wa.record(ctx, tx, rec.event(ctx, EventCreated, key, up.Size, up.Checksum))
+	})
 }
 
-// UpsertData insert data in the store
-func (wa *WebApp) UpsertData(ctx context.Context, key, ns string, data []byte) error {
-	// wa.dbs[ns].Exec("INSERT INTO data(data_id, data, )")
-	_, err := wa.dbs[ns].ExecContext(ctx, "INSERT INTO data (data_id, data) VALUES ($1, $2) ON CONFLICT(data_id) DO UPDATE SET data=$2", key, data)
-	if err != nil {
-		return err
-	}
-	return nil
+// UpsertData insert or replace data in the store, tags sent are added
+// to the tags that the object already has. It returns true if the
+// object didn't exist.
+func (wa *WebApp) UpsertData(ctx context.Context, ns string, db *store.DB, key string, up *Upload, tags Tags) (bool, error) {
+	var created bool
+	rec := wa.recorder(ctx, ns)
+	defer rec.done()
+	err := db.Write(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		exists, err := dataExists(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		created = !exists && !up.replaces
+		up, err := prepareObject(ctx, tx, key, up)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO data (data_id, data, size, chunk_size, checksum, dedup, updated_at) VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP) ON CONFLICT(data_id) DO UPDATE SET data=$2, size=$3, chunk_size=$4, checksum=$5, dedup=$6, updated_at=CURRENT_TIMESTAMP",
+			key, up.Data, up.Size, up.ChunkSize, up.Checksum, up.dedup)
+		if err != nil {
+			return err
+		}
+		if err := up.commitChunks(ctx, tx, key); err != nil {
+			return err
+		}
+		if err := setTags(ctx, tx, key, tags); err != nil {
+			return err
+		}
+		typ := EventUpdated
+		if created {
+			typ = EventCreated
+		}
+		return wa.record(ctx, tx, rec.event(ctx, typ, key, up.Size, up.Checksum))
+	})
+	return created, err
 }
 
 // PostData Write data to the sqlite file
@@ -253,21 +469,31 @@ func (wa *WebApp) PostData(w http.ResponseWriter, r *http.Request) {
 	dataPath := chi.URLParam(r, "data")
 	ns := chi.URLParam(r, "ns")
 
-	var zdata bytes.Buffer
-	zw := zlib.NewWriter(&zdata)
-
-	// bucket := JumpHash(dataPath, wa.buckets)
-	buf, err := ioutil.ReadAll(r.Body)
+	// in a partitioned namespace the key could be in any file
+	if prev, err := wa.findDB(r.Context(), ns, dataPath); err == nil && prev != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": "data already exists"})
+		return
+	}
+	db, err := wa.writeDB(r.Context(), ns)
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	quota, err := getQuota(r.Context(), db)
 	if err != nil {
 		wa.render.JSON(w, http.StatusInternalServerError,
 			map[string]string{"error": fmt.Sprintf("%s", err)})
 		return
-
 	}
-	zw.Write(buf)
-	zw.Close()
 
-	err = wa.InsertData(r.Context(), dataPath, ns, zdata.Bytes())
+	// bucket := JumpHash(dataPath, wa.buckets)
+	up, err := wa.readBody(r, ns, dataPath, db, quota)
+	if status := quotaStatus(err); status != 0 {
+		wa.render.JSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		wa.render.JSON(w, http.StatusInternalServerError,
 			map[string]string{"error": fmt.Sprintf("%s", err)})
@@ -275,12 +501,18 @@ func (wa *WebApp) PostData(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	if wa.producer != nil {
-		nsStream := fmt.Sprintf("RD.%s", ns)
-		wa.producer.SendTo(r.Context(), nsStream, map[string]interface{}{
-			"namespace": ns,
-			"path":      dataPath,
-		})
+	err = wa.InsertData(r.Context(), ns, db, dataPath, up, tagsFromHeaders(r.Header))
+	if err != nil {
+		up.discard(db)
+	}
+	if status := quotaStatus(err); status != 0 {
+		wa.render.JSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
 
 	}
 
@@ -299,21 +531,25 @@ func (wa *WebApp) PutData(w http.ResponseWriter, r *http.Request) {
 	dataPath := chi.URLParam(r, "data")
 	ns := chi.URLParam(r, "ns")
 
-	var zdata bytes.Buffer
-	zw := zlib.NewWriter(&zdata)
-
-	// bucket := JumpHash(dataPath, wa.buckets)
-	buf, err := ioutil.ReadAll(r.Body)
+	db, err := wa.writeDB(r.Context(), ns)
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	quota, err := getQuota(r.Context(), db)
 	if err != nil {
 		wa.render.JSON(w, http.StatusInternalServerError,
 			map[string]string{"error": fmt.Sprintf("%s", err)})
 		return
-
 	}
-	zw.Write(buf)
-	zw.Close()
 
-	err = wa.UpsertData(r.Context(), dataPath, ns, zdata.Bytes())
+	// bucket := JumpHash(dataPath, wa.buckets)
+	up, err := wa.readBody(r, ns, dataPath, db, quota)
+	if status := quotaStatus(err); status != 0 {
+		wa.render.JSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		wa.render.JSON(w, http.StatusInternalServerError,
 			map[string]string{"error": fmt.Sprintf("%s", err)})
@@ -321,12 +557,37 @@ func (wa *WebApp) PutData(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	if wa.producer != nil {
-		nsStream := fmt.Sprintf("%s.%s", wa.producer.Namespace, ns)
-		wa.producer.SendTo(r.Context(), nsStream, map[string]interface{}{
-			"namespace": ns,
-			"path":      dataPath,
-		})
+	// in a partitioned namespace the previous version could be in an older
+	// file, it's replaced by the new one keeping its tags.
+	tags := tagsFromHeaders(r.Header)
+	prev, _ := wa.findDB(r.Context(), ns, dataPath)
+	if prev != nil && prev != db {
+		up.replaces = true
+		if old, err := getTags(r.Context(), prev, dataPath); err == nil {
+			for k, v := range tags {
+				old[k] = v
+			}
+			tags = old
+		}
+	}
+
+	_, err = wa.UpsertData(r.Context(), ns, db, dataPath, up, tags)
+	if err != nil {
+		up.discard(db)
+	}
+	if err == nil && prev != nil && prev != db {
+		if _, err := deleteKeys(r.Context(), prev, nil, dataPath); err != nil {
+			log.Printf("Error deleting old version of %s/%s: %s", ns, dataPath, err)
+		}
+	}
+	if status := quotaStatus(err); status != 0 {
+		wa.render.JSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
 
 	}
 
@@ -343,26 +604,53 @@ func (wa *WebApp) GetOneData(w http.ResponseWriter, r *http.Request) {
 	dataPath := chi.URLParam(r, "data")
 	ns := chi.URLParam(r, "ns")
 
+	db, err := wa.findDB(r.Context(), ns, dataPath)
+	if err != nil || db == nil {
+		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Data not found"})
+		return
+	}
+
+	// a read transaction keeps the chunks of the object consistent
+	tx, err := db.BeginTxx(r.Context(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		wa.render.JSON(w, http.StatusInternalServerError,
+			map[string]string{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	defer tx.Rollback()
+
 	oneData := DataModel{}
-	err := wa.dbs[ns].Get(&oneData, "SELECT * FROM data where data_id = ?", dataPath)
+	err = tx.Get(&oneData, dataSelect+" WHERE data_id = ?", dataPath)
 	if err != nil {
 		wa.render.JSON(w, http.StatusNotFound, map[string]string{"error": "Data not found"})
 		return
 	}
 
+	tags, err := getTags(r.Context(), tx, dataPath)
+	if err == nil {
+		writeTagHeaders(w.Header(), tags)
+	}
+
 	//buff := []byte{120, 156, 202, 72, 205, 201, 201, 215, 81, 40, 207,
 	//	47, 202, 73, 225, 2, 4, 0, 0, 255, 255, 33, 231, 4, 147}
 
-	rb := bytes.NewReader(oneData.Data)
-	zr, err := zlib.NewReader(rb)
-	if err != nil {
-		wa.render.JSON(w, http.StatusInternalServerError,
-			map[string]string{"error": fmt.Sprintf("%s", err)})
-		return
+	var content io.ReadSeeker
+	if oneData.ChunkSize > 0 {
+		content = newChunkReader(r.Context(), tx, oneData.contentKey(), oneData.Size, oneData.ChunkSize)
+	} else {
+		zr := newZlibReader(oneData.Data, oneData.Size)
+		if err := zr.reset(); err != nil {
+			wa.render.JSON(w, http.StatusInternalServerError,
+				map[string]string{"error": fmt.Sprintf("%s", err)})
+			return
+		}
+		content = zr
 	}
-	data, _ := ioutil.ReadAll(zr)
 
-	w.Write(data)
+	// ServeContent handles HEAD, Range (single and multi range with 206),
+	// Accept-Ranges and the conditional headers.
+	modTime, _ := time.Parse(sqliteTime, oneData.UpdatedAt)
+	http.ServeContent(w, r, "", modTime, content)
 }
 
 func (wa *WebApp) DelOneData(w http.ResponseWriter, r *http.Request) {
@@ -370,10 +658,14 @@ func (wa *WebApp) DelOneData(w http.ResponseWriter, r *http.Request) {
 	dataPath := chi.URLParam(r, "data")
 	ns := chi.URLParam(r, "ns")
 
-	_, err := wa.dbs[ns].ExecContext(r.Context(), "DELETE FROM data where data_id  = ?", dataPath)
-	if err != nil {
-		wa.render.JSON(w, http.StatusInternalServerError, map[string]string{"error": "Cannot delete data"})
-		return
+	rec := wa.recorder(r.Context(), ns)
+	defer rec.done()
+	for _, db := range wa.nsDBs(ns) {
+		_, err := deleteKeys(r.Context(), db, rec.deletes, dataPath)
+		if err != nil {
+			wa.render.JSON(w, http.StatusInternalServerError, map[string]string{"error": "Cannot delete data"})
+			return
+		}
 	}
 
 	wa.render.JSON(w, http.StatusOK, map[string]string{"msg": "ok"})
@@ -416,7 +708,8 @@ func (wa *WebApp) GetAllData(w http.ResponseWriter, r *http.Request) {
 
 	err1 := getNumberQueryParam(&page, r, "page")
 	err2 := getNumberQueryParam(&limit, r, "limit")
-	if err1 != nil || err2 != nil {
+	filter, err3 := parseListFilter(r)
+	if err1 != nil || err2 != nil || err3 != nil {
 		wa.render.JSON(w, http.StatusInternalServerError,
 			map[string]string{"error": "bad param"})
 		return
@@ -426,10 +719,13 @@ func (wa *WebApp) GetAllData(w http.ResponseWriter, r *http.Request) {
 	offset := limit * (page - 1)
 	ns := chi.URLParam(r, "ns")
 
-	ad := []DataModel{}
-	var total int
-	row := wa.dbs[ns].QueryRow("SELECT count(*) FROM data;")
-	_ = row.Scan(&total)
+	ids, owners, total, err := listPage(r.Context(), wa.nsDBs(ns), filter, "created", "asc", limit, offset)
+	if err != nil {
+		fmt.Println("Error geting value ", err)
+		wa.render.JSON(w, http.StatusInternalServerError, map[string]string{"error": "Cannot get data"})
+		return
+
+	}
 
 	nextPage := page + 1
 	nextOffset := limit * page
@@ -437,13 +733,32 @@ func (wa *WebApp) GetAllData(w http.ResponseWriter, r *http.Request) {
 		nextPage = -1
 	}
 
-	err := wa.dbs[ns].Select(&ad, "SELECT * FROM data LIMIT ? OFFSET ?;", limit, offset)
-	// err := wa.dbs[ns].Select(&ad, "SELECT * FROM data")
-	if err != nil {
-		fmt.Println("Error geting value ", err)
-		wa.render.JSON(w, http.StatusInternalServerError, map[string]string{"error": "Cannot get data"})
-		return
-
+	// the rows of the page are loaded from the file where each one is
+	found := map[string]DataModel{}
+	for db, keys := range byDB(ids, owners) {
+		q, args, err := sqlx.In(dataSelect+" WHERE data_id IN (?)", keys)
+		if err != nil {
+			wa.render.JSON(w, http.StatusInternalServerError, map[string]string{"error": "Cannot get data"})
+			return
+		}
+		rows := []DataModel{}
+		if err := db.SelectContext(r.Context(), &rows, q, args...); err != nil {
+			fmt.Println("Error geting value ", err)
+			wa.render.JSON(w, http.StatusInternalServerError, map[string]string{"error": "Cannot get data"})
+			return
+		}
+		tags, _ := getTagsByKeys(r.Context(), db, keys)
+		for _, row := range rows {
+			row.Tags = tags[row.DataID]
+			found[row.DataID] = row
+		}
+	}
+	ad := []DataModel{}
+	for _, id := range ids {
+		// it could be deleted between both queries
+		if row, ok := found[id.DataID]; ok {
+			ad = append(ad, row)
+		}
 	}
 
 	// err = wa.render.JSON(w, http.StatusOK, map[string][]Data{"rows": ad})
@@ -457,6 +772,9 @@ func (wa *WebApp) GetAllData(w http.ResponseWriter, r *http.Request) {
 type DataID struct {
 	DataID    string `db:"data_id" json:"dataID"`
 	CreatedAt string `db:"created_at" json:"createdAt"`
+	UpdatedAt string `db:"updated_at" json:"updatedAt"`
+	Size      int64  `db:"size" json:"size"`
+	Tags      Tags   `db:"-" json:"tags,omitempty"`
 }
 
 type DataIDResponse struct {
@@ -465,6 +783,7 @@ type DataIDResponse struct {
 	Next  int      `json:"next"`
 }
 
+// GetIDData Returns only the IDs, by default newest objects first
 func (wa *WebApp) GetIDData(w http.ResponseWriter, r *http.Request) {
 
 	page := 1
@@ -472,7 +791,8 @@ func (wa *WebApp) GetIDData(w http.ResponseWriter, r *http.Request) {
 
 	err1 := getNumberQueryParam(&page, r, "page")
 	err2 := getNumberQueryParam(&limit, r, "limit")
-	if err1 != nil || err2 != nil {
+	filter, err3 := parseListFilter(r)
+	if err1 != nil || err2 != nil || err3 != nil {
 		wa.render.JSON(w, http.StatusInternalServerError,
 			map[string]string{"error": "bad param"})
 		return
@@ -482,10 +802,13 @@ func (wa *WebApp) GetIDData(w http.ResponseWriter, r *http.Request) {
 	offset := limit * (page - 1)
 	ns := chi.URLParam(r, "ns")
 
-	ad := []DataID{}
-	var total int
-	row := wa.dbs[ns].QueryRow("SELECT count(*) FROM data;")
-	_ = row.Scan(&total)
+	ad, owners, total, err := listPage(r.Context(), wa.nsDBs(ns), filter, "created", "desc", limit, offset)
+	if err != nil {
+		fmt.Println("Error geting value ", err)
+		wa.render.JSON(w, http.StatusInternalServerError, map[string]string{"error": "Cannot get data"})
+		return
+
+	}
 
 	nextPage := page + 1
 	nextOffset := limit * page
@@ -493,13 +816,14 @@ func (wa *WebApp) GetIDData(w http.ResponseWriter, r *http.Request) {
 		nextPage = -1
 	}
 
-	err := wa.dbs[ns].Select(&ad, "SELECT data_id, created_at FROM data ORDER BY created_at desc LIMIT ? OFFSET ?;", limit, offset)
-	// err := wa.dbs[ns].Select(&ad, "SELECT * FROM data")
-	if err != nil {
-		fmt.Println("Error geting value ", err)
-		wa.render.JSON(w, http.StatusInternalServerError, map[string]string{"error": "Cannot get data"})
-		return
-
+	for db, keys := range byDB(ad, owners) {
+		if tags, err := getTagsByKeys(r.Context(), db, keys); err == nil {
+			for i := range ad {
+				if t, ok := tags[ad[i].DataID]; ok {
+					ad[i].Tags = t
+				}
+			}
+		}
 	}
 
 	// err = wa.render.JSON(w, http.StatusOK, map[string][]Data{"rows": ad})
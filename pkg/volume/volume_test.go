@@ -1,10 +1,25 @@
 package volume
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/algorinfo/rawstore/pkg/store"
 	"github.com/stretchr/testify/assert"
@@ -34,10 +49,1207 @@ func TestLoadNS(t *testing.T) {
 	log.Println("DirName...:", dirName)
 
 	fn := fmt.Sprintf("%s/%s", dirName, "test")
-	store.CreateDB(fn)
+	store.CreateDB(fn, dataSchemaV1)
 
 	vol := New(WithConfig(cfg))
 	LoadNS(vol)
 	assert.Equal(t, len(vol.namespaces), 2)
-	assert.Equal(t, vol.namespaces[1], "test.db")
+	assert.Equal(t, vol.namespaces[1], "test")
+}
+
+func TestCreateNS(t *testing.T) {
+	vol := newTestVolume(t)
+	rr := doRequest(vol, "POST", "/v1/namespace", strings.NewReader(`{"name": "other"}`), nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Contains(t, vol.nsNames(), "other")
+
+	for _, name := range []string{"", "_archive", "../other", ".hidden"} {
+		rr = doRequest(vol, "POST", "/v1/namespace", strings.NewReader(`{"name": "`+name+`"}`), nil)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, name)
+	}
+
+	// a file which can't be created is an error, not a crash
+	os.Mkdir(filepath.Join(vol.cfg.NSDir, "dir.db"), 0755)
+	rr = doRequest(vol, "POST", "/v1/namespace", strings.NewReader(`{"name": "dir"}`), nil)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.NotContains(t, vol.nsNames(), "dir")
+}
+
+func newTestVolume(t *testing.T) *WebApp {
+	dirName := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.NSDir = dirName
+	return New(WithConfig(cfg))
+}
+
+func doRequest(wa *WebApp, method, path string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	wa.r.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTags(t *testing.T) {
+	vol := newTestVolume(t)
+
+	rr := doRequest(vol, "PUT", "/default/one", strings.NewReader("hello"),
+		map[string]string{"X-RD-Tag-source": "sitemap"})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	rr = doRequest(vol, "PUT", "/default/two", strings.NewReader("world"),
+		map[string]string{"X-RD-Tag-source": "feed"})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	rr = doRequest(vol, "GET", "/default/one", nil, nil)
+	assert.Equal(t, "hello", rr.Body.String())
+	assert.Equal(t, "sitemap", rr.Header().Get("X-RD-Tag-source"))
+
+	rr = doRequest(vol, "GET", "/v1/data/default/_list?tag=source:feed", nil, nil)
+	var ids DataIDResponse
+	json.Unmarshal(rr.Body.Bytes(), &ids)
+	assert.Equal(t, 1, ids.Total)
+	assert.Equal(t, "two", ids.Rows[0].DataID)
+	assert.Equal(t, "feed", ids.Rows[0].Tags["source"])
+
+	rr = doRequest(vol, "PATCH", "/v1/data/default/_tags/two",
+		strings.NewReader(`{"source": "sitemap", "lang": "es"}`), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = doRequest(vol, "GET", "/v1/data/default/_list?tag=source:sitemap&tag=lang:es", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &ids)
+	assert.Equal(t, 1, ids.Total)
+	assert.Equal(t, "two", ids.Rows[0].DataID)
+}
+
+func TestListOrder(t *testing.T) {
+	vol := newTestVolume(t)
+	for _, k := range []string{"b", "c", "a"} {
+		doRequest(vol, "PUT", "/default/"+k, strings.NewReader(k+k), nil)
+	}
+	doRequest(vol, "PUT", "/default/c", strings.NewReader("c"), nil)
+
+	var ids DataIDResponse
+	rr := doRequest(vol, "GET", "/v1/data/default/_list?sort=key&order=asc", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &ids)
+	assert.Equal(t, 3, ids.Total)
+	assert.Equal(t, "a", ids.Rows[0].DataID)
+	assert.Equal(t, "c", ids.Rows[2].DataID)
+
+	rr = doRequest(vol, "GET", "/v1/data/default/_list?sort=size&order=asc", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &ids)
+	assert.Equal(t, "c", ids.Rows[0].DataID)
+	assert.Equal(t, int64(1), ids.Rows[0].Size)
+
+	rr = doRequest(vol, "GET", "/v1/data/default/_list?since=2100-01-01", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &ids)
+	assert.Equal(t, 0, ids.Total)
+
+	rr = doRequest(vol, "GET", "/v1/data/default?sort=bad", nil, nil)
+	assert.NotEqual(t, http.StatusOK, rr.Code)
+}
+
+func TestBulkDelete(t *testing.T) {
+	vol := newTestVolume(t)
+	for _, k := range []string{"crawl-1", "crawl-2", "crawl*3", "other"} {
+		doRequest(vol, "PUT", "/default/"+k, strings.NewReader(k), nil)
+	}
+
+	var dr DeleteResponse
+	rr := doRequest(vol, "POST", "/v1/data/default/_delete",
+		strings.NewReader(`{"prefix": "crawl-", "dryRun": true}`), nil)
+	json.Unmarshal(rr.Body.Bytes(), &dr)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, int64(2), dr.Matched)
+
+	rr = doRequest(vol, "POST", "/v1/data/default/_delete", strings.NewReader(`{}`), nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = doRequest(vol, "POST", "/v1/data/default/_delete",
+		strings.NewReader(`{"prefix": "crawl-"}`), nil)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	var job Job
+	json.Unmarshal(rr.Body.Bytes(), &job)
+
+	assert.Eventually(t, func() bool {
+		j, _ := vol.jobs.Get(job.ID)
+		return j.Status == JobDone && j.Counters["deleted"] == 2
+	}, time.Second, 10*time.Millisecond)
+
+	var ids DataIDResponse
+	rr = doRequest(vol, "GET", "/v1/data/default/_list?sort=key", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &ids)
+	assert.Equal(t, 2, ids.Total)
+
+	// finished jobs are removed after the retention
+	jobRetention = 0
+	defer func() { jobRetention = time.Hour }()
+	_, ok := vol.jobs.Get(job.ID)
+	assert.True(t, ok)
+	assert.Empty(t, vol.jobs.List())
+	_, ok = vol.jobs.Get(job.ID)
+	assert.False(t, ok)
+}
+
+func TestNSStats(t *testing.T) {
+	vol := newTestVolume(t)
+	doRequest(vol, "PUT", "/default/one", strings.NewReader(strings.Repeat("a", 1000)), nil)
+	doRequest(vol, "PUT", "/default/two", strings.NewReader(strings.Repeat("b", 1000)), nil)
+
+	var st NamespaceStats
+	rr := doRequest(vol, "GET", "/v1/namespace/default/stats", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &st)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, int64(2), st.Objects)
+	assert.Equal(t, int64(2000), st.RawBytes)
+	assert.Greater(t, st.CompressionRatio, 1.0)
+	assert.Greater(t, st.FileSize, int64(0))
+
+	rr = doRequest(vol, "GET", "/v1/namespace/nope/stats", nil, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	var sr StatusResponse
+	rr = doRequest(vol, "GET", "/status", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &sr)
+	assert.Equal(t, int64(2), sr.Summary["default"].Objects)
+	assert.Equal(t, st.CompressedBytes, sr.Summary["default"].Bytes)
+}
+
+func TestQuota(t *testing.T) {
+	vol := newTestVolume(t)
+	rr := doRequest(vol, "PUT", "/v1/namespace/default/quota",
+		strings.NewReader(`{"maxObjects": 2, "maxObjectSize": 10}`), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = doRequest(vol, "PUT", "/default/big", strings.NewReader(strings.Repeat("a", 11)), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	for _, k := range []string{"one", "two"} {
+		rr = doRequest(vol, "PUT", "/default/"+k, strings.NewReader(k), nil)
+		assert.Equal(t, http.StatusCreated, rr.Code)
+	}
+	rr = doRequest(vol, "PUT", "/default/three", strings.NewReader("three"), nil)
+	assert.Equal(t, http.StatusInsufficientStorage, rr.Code)
+	// replacing an existing object doesn't add objects
+	rr = doRequest(vol, "PUT", "/default/two", strings.NewReader("again"), nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	doRequest(vol, "DELETE", "/default/one", nil, nil)
+	var qr QuotaResponse
+	rr = doRequest(vol, "GET", "/v1/namespace/default/quota", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &qr)
+	assert.Equal(t, int64(1), qr.Usage.Objects)
+	assert.Equal(t, int64(2), qr.Quota.MaxObjects)
+
+	// the quota applies to all the partitions together
+	rr = doRequest(vol, "PUT", "/v1/namespace/default/options",
+		strings.NewReader(`{"partition": {"by": "size", "maxBytes": 1}}`), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = doRequest(vol, "PUT", "/default/three", strings.NewReader("three"), nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	rr = doRequest(vol, "PUT", "/default/four", strings.NewReader("four"), nil)
+	assert.Equal(t, http.StatusInsufficientStorage, rr.Code)
+	rr = doRequest(vol, "PUT", "/default/two", strings.NewReader("moved"), nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	rr = doRequest(vol, "GET", "/v1/namespace/default/quota", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &qr)
+	assert.Equal(t, int64(2), qr.Usage.Objects)
+}
+
+func TestMaxBodySize(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NSDir = t.TempDir()
+	cfg.MaxBodySize = 10
+	vol := New(WithConfig(cfg))
+
+	rr := doRequest(vol, "PUT", "/default/big", strings.NewReader(strings.Repeat("a", 11)), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	// without Content-Length the body is cut while it's read
+	rr = doRequest(vol, "PUT", "/default/big", io.MultiReader(strings.NewReader(strings.Repeat("a", 11))), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	rr = doRequest(vol, "PUT", "/default/small", strings.NewReader(strings.Repeat("a", 10)), nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	rr = doRequest(vol, "GET", "/default/small", nil, nil)
+	assert.Equal(t, strings.Repeat("a", 10), rr.Body.String())
+}
+
+func TestChunkedObjects(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NSDir = t.TempDir()
+	cfg.ChunkSize = 10
+	vol := New(WithConfig(cfg))
+
+	body := "0123456789abcdefghijABCDEFGHIJxyz"
+	rr := doRequest(vol, "PUT", "/default/big", strings.NewReader(body), nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var chunks int
+	vol.dbs["default"].db.Get(&chunks, "SELECT count(*) FROM chunks WHERE data_id = 'big'")
+	assert.Equal(t, 4, chunks)
+
+	rr = doRequest(vol, "GET", "/default/big", nil, nil)
+	assert.Equal(t, body, rr.Body.String())
+
+	rr = doRequest(vol, "GET", "/default/big", nil, map[string]string{"Range": "bytes=8-21"})
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, body[8:22], rr.Body.String())
+
+	// exactly one chunk is stored inline
+	rr = doRequest(vol, "PUT", "/default/big", strings.NewReader(body[:10]), nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	vol.dbs["default"].db.Get(&chunks, "SELECT count(*) FROM chunks")
+	assert.Equal(t, 0, chunks)
+	rr = doRequest(vol, "GET", "/default/big", nil, nil)
+	assert.Equal(t, body[:10], rr.Body.String())
+
+	doRequest(vol, "POST", "/default/other", strings.NewReader(body), nil)
+	rr = doRequest(vol, "POST", "/default/other", strings.NewReader(body), nil)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	doRequest(vol, "DELETE", "/default/other", nil, nil)
+	vol.dbs["default"].db.Get(&chunks, "SELECT count(*) FROM chunks")
+	assert.Equal(t, 0, chunks)
+
+	var qr QuotaResponse
+	rr = doRequest(vol, "GET", "/v1/namespace/default/quota", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &qr)
+	var stored int64
+	vol.dbs["default"].db.Get(&stored, "SELECT sum(length(data)) FROM data")
+	assert.Equal(t, stored, qr.Usage.Bytes)
+
+	// the chunks left by a crash are removed with its usage when it's opened
+	vol.dbs["default"].db.W.MustExec("INSERT INTO chunks (data_id, seq, data) VALUES ('_upload/1', 0, 'stale')")
+	vol.mu.Lock()
+	vol.closeNS("default", vol.dbs["default"])
+	vol.mu.Unlock()
+	rr = doRequest(vol, "GET", "/v1/namespace/default/quota", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &qr)
+	assert.Equal(t, stored, qr.Usage.Bytes)
+	vol.dbs["default"].db.Get(&chunks, "SELECT count(*) FROM chunks")
+	assert.Equal(t, 0, chunks)
+}
+
+func TestRange(t *testing.T) {
+	vol := newTestVolume(t)
+	body := strings.Repeat("0123456789", 100)
+	doRequest(vol, "PUT", "/default/one", strings.NewReader(body), nil)
+
+	rr := doRequest(vol, "GET", "/default/one", nil, nil)
+	assert.Equal(t, "bytes", rr.Header().Get("Accept-Ranges"))
+	assert.Equal(t, body, rr.Body.String())
+
+	rr = doRequest(vol, "GET", "/default/one", nil, map[string]string{"Range": "bytes=995-"})
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, "56789", rr.Body.String())
+	assert.Equal(t, "bytes 995-999/1000", rr.Header().Get("Content-Range"))
+
+	rr = doRequest(vol, "GET", "/default/one", nil, map[string]string{"Range": "bytes=0-1,10-11"})
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Contains(t, rr.Header().Get("Content-Type"), "multipart/byteranges")
+
+	rr = doRequest(vol, "GET", "/default/one", nil, map[string]string{"Range": "bytes=2000-"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rr.Code)
+
+	rr = doRequest(vol, "HEAD", "/default/one", nil, nil)
+	assert.Equal(t, "1000", rr.Header().Get("Content-Length"))
+}
+
+func TestDedup(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NSDir = t.TempDir()
+	cfg.ChunkSize = 10
+	vol := New(WithConfig(cfg))
+	db := vol.dbs["default"].db
+
+	rr := doRequest(vol, "PUT", "/v1/namespace/default/options", strings.NewReader(`{"dedup": true}`), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	small := "hello"
+	big := "0123456789abcdefghijABCDEFGHIJxyz"
+	for _, k := range []string{"a", "b", "c"} {
+		rr = doRequest(vol, "PUT", "/default/"+k, strings.NewReader(small), nil)
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		rr = doRequest(vol, "PUT", "/default/big-"+k, strings.NewReader(big), nil)
+		assert.Equal(t, http.StatusCreated, rr.Code)
+	}
+	var blobs, refs, chunks int
+	db.Get(&blobs, "SELECT count(*) FROM blobs")
+	db.Get(&refs, "SELECT sum(refs) FROM blobs")
+	db.Get(&chunks, "SELECT count(*) FROM chunks")
+	assert.Equal(t, 2, blobs)
+	assert.Equal(t, 6, refs)
+	assert.Equal(t, 4, chunks)
+
+	rr = doRequest(vol, "GET", "/default/b", nil, nil)
+	assert.Equal(t, small, rr.Body.String())
+	rr = doRequest(vol, "GET", "/default/big-c", nil, map[string]string{"Range": "bytes=8-21"})
+	assert.Equal(t, big[8:22], rr.Body.String())
+
+	// replacing and deleting the objects releases the blobs
+	doRequest(vol, "PUT", "/default/a", strings.NewReader("other"), nil)
+	doRequest(vol, "DELETE", "/default/b", nil, nil)
+	doRequest(vol, "DELETE", "/default/c", nil, nil)
+	rr = doRequest(vol, "POST", "/v1/data/default/_delete", strings.NewReader(`{"prefix": "big-"}`), nil)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	var job Job
+	json.Unmarshal(rr.Body.Bytes(), &job)
+	waitJob(t, vol, &job)
+
+	db.Get(&blobs, "SELECT count(*) FROM blobs")
+	db.Get(&chunks, "SELECT count(*) FROM chunks")
+	assert.Equal(t, 1, blobs)
+	assert.Equal(t, 0, chunks)
+	rr = doRequest(vol, "GET", "/default/a", nil, nil)
+	assert.Equal(t, "other", rr.Body.String())
+
+	var qr QuotaResponse
+	rr = doRequest(vol, "GET", "/v1/namespace/default/quota", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &qr)
+	var stored int64
+	db.Get(&stored, "SELECT sum(length(data)) FROM blobs")
+	assert.Equal(t, stored, qr.Usage.Bytes)
+}
+
+func waitJob(t *testing.T, wa *WebApp, job *Job) *Job {
+	for i := 0; i < 200 && job.Status == JobRunning; i++ {
+		time.Sleep(10 * time.Millisecond)
+		rr := doRequest(wa, "GET", "/v1/jobs/"+job.ID, nil, nil)
+		json.Unmarshal(rr.Body.Bytes(), job)
+	}
+	assert.Equal(t, JobDone, job.Status, job.Error)
+	return job
+}
+
+func TestCompact(t *testing.T) {
+	for _, mode := range []string{CompactFull, CompactIncremental} {
+		vol := newTestVolume(t)
+		payload := strings.Repeat("x", 64<<10)
+		for i := 0; i < 50; i++ {
+			// random data is not compressed
+			b := make([]byte, 16<<10)
+			rand.Read(b)
+			doRequest(vol, "PUT", fmt.Sprintf("/default/k%d", i), bytes.NewReader(append(b, payload...)), nil)
+		}
+		rr := doRequest(vol, "POST", "/v1/data/default/_delete", strings.NewReader(`{"prefix": "k"}`), nil)
+		var job Job
+		json.Unmarshal(rr.Body.Bytes(), &job)
+		waitJob(t, vol, &job)
+
+		rr = doRequest(vol, "POST", "/v1/namespace/default/_compact",
+			strings.NewReader(fmt.Sprintf(`{"mode": %q}`, mode)), nil)
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		json.Unmarshal(rr.Body.Bytes(), &job)
+		waitJob(t, vol, &job)
+		assert.Greater(t, job.Counters["reclaimed"], int64(0), mode)
+		assert.Less(t, job.Counters["sizeAfter"], job.Counters["sizeBefore"], mode)
+	}
+
+	vol := newTestVolume(t)
+	rr := doRequest(vol, "POST", "/v1/namespace/default/_compact", strings.NewReader(`{"mode": "other"}`), nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestCheck(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NSDir = t.TempDir()
+	cfg.ChunkSize = 10
+	vol := New(WithConfig(cfg))
+	db := vol.dbs["default"].db
+
+	doRequest(vol, "PUT", "/default/good", strings.NewReader("hello"), nil)
+	doRequest(vol, "PUT", "/default/zlib", strings.NewReader("hello"), nil)
+	doRequest(vol, "PUT", "/default/sum", strings.NewReader("hello"), nil)
+	doRequest(vol, "PUT", "/default/big", strings.NewReader("0123456789abcdefghijxyz"), nil)
+	db.W.MustExec("UPDATE data SET data = x'789c0000' WHERE data_id = 'zlib'")
+	db.W.MustExec("UPDATE data SET checksum = 'bad' WHERE data_id = 'sum'")
+	db.W.MustExec("DELETE FROM chunks WHERE data_id = 'big' AND seq = 1")
+
+	rr := doRequest(vol, "POST", "/v1/namespace/default/_check", strings.NewReader(`{"quarantine": true}`), nil)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	var job Job
+	json.Unmarshal(rr.Body.Bytes(), &job)
+	waitJob(t, vol, &job)
+	assert.Equal(t, int64(4), job.Counters["checked"])
+	assert.Equal(t, int64(3), job.Counters["bad"])
+	assert.Equal(t, int64(3), job.Counters["quarantined"])
+
+	var keys []string
+	db.Select(&keys, "SELECT data_id FROM data")
+	assert.Equal(t, []string{"good"}, keys)
+	db.Select(&keys, "SELECT data_id FROM quarantine ORDER BY data_id")
+	assert.Equal(t, []string{"big", "sum", "zlib"}, keys)
+	var chunks int
+	db.Get(&chunks, "SELECT count(*) FROM chunks WHERE data_id = ?", quarantinePrefix+"big")
+	assert.Equal(t, 2, chunks)
+
+	rep, err := CheckFile(context.Background(), cfg.NSDir, "default", false)
+	assert.NoError(t, err)
+	assert.True(t, rep.OK())
+
+	// the chunks of a shared blob are copied, the other object keeps them
+	doRequest(vol, "PUT", "/v1/namespace/default/options", strings.NewReader(`{"dedup": true}`), nil)
+	for _, k := range []string{"d1", "d2"} {
+		doRequest(vol, "PUT", "/default/"+k, strings.NewReader("0123456789abcdefghijxyz"), nil)
+	}
+	db.W.MustExec("UPDATE data SET size = 99 WHERE data_id = 'd1'")
+	rr = doRequest(vol, "POST", "/v1/namespace/default/_check", strings.NewReader(`{"quarantine": true}`), nil)
+	json.Unmarshal(rr.Body.Bytes(), &job)
+	waitJob(t, vol, &job)
+	assert.Equal(t, int64(1), job.Counters["quarantined"])
+	db.Get(&chunks, "SELECT count(*) FROM chunks WHERE data_id = ?", quarantinePrefix+"d1")
+	assert.Equal(t, 3, chunks)
+	rr = doRequest(vol, "GET", "/default/d2", nil, nil)
+	assert.Equal(t, "0123456789abcdefghijxyz", rr.Body.String())
+
+	// without quarantine the file is not migrated
+	dir := t.TempDir()
+	store.CreateDB(filepath.Join(dir, "old"), dataSchemaV1).Close()
+	_, err = CheckFile(context.Background(), dir, "old", false)
+	assert.Error(t, err)
+	old, _ := store.OpenDB(filepath.Join(dir, "old"), store.DefaultSQLiteOptions())
+	var version int
+	old.Get(&version, "PRAGMA user_version")
+	old.Close()
+	assert.Equal(t, 0, version)
+}
+
+func TestPartitions(t *testing.T) {
+	vol := newTestVolume(t)
+	doRequest(vol, "PUT", "/default/old", strings.NewReader("old"), nil)
+
+	rr := doRequest(vol, "PUT", "/v1/namespace/default/options",
+		strings.NewReader(`{"partition": {"by": "size"}}`), nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	// every write starts a new partition
+	rr = doRequest(vol, "PUT", "/v1/namespace/default/options",
+		strings.NewReader(`{"partition": {"by": "size", "maxBytes": 1}}`), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	for _, k := range []string{"a", "b", "c"} {
+		rr = doRequest(vol, "PUT", "/default/"+k, strings.NewReader(k), map[string]string{"X-Rd-Tag-key": k})
+		assert.Equal(t, http.StatusCreated, rr.Code)
+	}
+
+	var parts []PartitionInfo
+	rr = doRequest(vol, "GET", "/v1/namespace/default/partitions", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &parts)
+	assert.Equal(t, 3, len(parts))
+
+	rr = doRequest(vol, "GET", "/default/old", nil, nil)
+	assert.Equal(t, "old", rr.Body.String())
+	rr = doRequest(vol, "GET", "/default/b", nil, nil)
+	assert.Equal(t, "b", rr.Body.String())
+
+	var ids DataIDResponse
+	rr = doRequest(vol, "GET", "/v1/data/default/_list?sort=key&order=asc&limit=2&page=2", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &ids)
+	assert.Equal(t, 4, ids.Total)
+	assert.Equal(t, 2, len(ids.Rows))
+	assert.Equal(t, "c", ids.Rows[0].DataID)
+	assert.Equal(t, "c", ids.Rows[0].Tags["key"])
+	assert.Equal(t, "old", ids.Rows[1].DataID)
+
+	// the new version moves to the last partition keeping the tags
+	doRequest(vol, "PUT", "/default/a", strings.NewReader("a2"), nil)
+	var all AllData
+	rr = doRequest(vol, "GET", "/v1/data/default", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &all)
+	assert.Equal(t, 4, all.Total)
+	for _, row := range all.Rows {
+		if row.DataID != "old" {
+			assert.Equal(t, row.DataID, row.Tags["key"])
+		}
+	}
+	rr = doRequest(vol, "POST", "/default/b", strings.NewReader("b2"), nil)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	rr = doRequest(vol, "GET", "/v1/namespace/default/partitions", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &parts)
+	assert.Equal(t, 4, len(parts))
+	assert.Equal(t, int64(0), parts[0].Objects)
+
+	rr = doRequest(vol, "DELETE", "/v1/namespace/default/partitions/"+parts[0].Name, nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = doRequest(vol, "POST", "/v1/namespace/default/partitions/"+parts[1].Name+"/_archive", nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	_, err := os.Stat(filepath.Join(vol.cfg.NSDir, archiveDir, "default", parts[1].Name+".db"))
+	assert.NoError(t, err)
+	rr = doRequest(vol, "GET", "/default/b", nil, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = doRequest(vol, "DELETE", "/v1/namespace/default/partitions/"+parts[2].Name, nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = doRequest(vol, "GET", "/v1/namespace/default/partitions", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &parts)
+	assert.Equal(t, 2, len(parts))
+	assert.Equal(t, PartitionArchived, parts[0].State)
+	rr = doRequest(vol, "DELETE", "/v1/namespace/default/partitions/"+parts[1].Name, nil, nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	// the file isn't dropped while a request uses the namespace
+	doRequest(vol, "PUT", "/default/d", strings.NewReader("d"), nil)
+	rr = doRequest(vol, "GET", "/v1/namespace/default/partitions", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &parts)
+	h := vol.acquire("default")
+	dropped := make(chan int)
+	go func() {
+		rr := doRequest(vol, "DELETE", "/v1/namespace/default/partitions/"+parts[1].Name, nil, nil)
+		dropped <- rr.Code
+	}()
+	select {
+	case <-dropped:
+		t.Fatal("partition dropped while the namespace is used")
+	case <-time.After(100 * time.Millisecond):
+	}
+	vol.release(h)
+	assert.Equal(t, http.StatusOK, <-dropped)
+
+	// a stream of the changes is closed, so it doesn't keep the drop waiting
+	drainTimeout = 2 * time.Second
+	defer func() { drainTimeout = 30 * time.Second }()
+	srv := httptest.NewServer(vol.r)
+	defer srv.Close()
+	rsp, err := http.Get(srv.URL + "/v1/data/default/_changes?stream=true")
+	assert.Nil(t, err)
+	defer rsp.Body.Close()
+	doRequest(vol, "PUT", "/default/e", strings.NewReader("e"), nil)
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, rsp.Body)
+		close(closed)
+	}()
+	rr = doRequest(vol, "DELETE", "/v1/namespace/default/partitions/"+parts[2].Name, nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("the stream of changes wasn't closed")
+	}
+
+	drainTimeout = 50 * time.Millisecond
+	h = vol.acquire("default")
+	rr = doRequest(vol, "DELETE", "/v1/namespace/default/partitions/"+parts[0].Name, nil, nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), ErrNSBusy.Error())
+	vol.release(h)
+}
+
+func TestModes(t *testing.T) {
+	vol := newTestVolume(t)
+	rr := doRequest(vol, "POST", "/v1/namespace", strings.NewReader(`{"name": "old"}`), nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	doRequest(vol, "PUT", "/old/one", strings.NewReader("hello"), nil)
+
+	rr = doRequest(vol, "PUT", "/v1/namespace/old/options", strings.NewReader(`{"mode": "ro"}`), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = doRequest(vol, "PUT", "/old/two", strings.NewReader("world"), nil)
+	assert.Equal(t, http.StatusLocked, rr.Code)
+	rr = doRequest(vol, "DELETE", "/old/one", nil, nil)
+	assert.Equal(t, http.StatusLocked, rr.Code)
+	rr = doRequest(vol, "GET", "/old/one", nil, nil)
+	assert.Equal(t, "hello", rr.Body.String())
+
+	rr = doRequest(vol, "PUT", "/v1/namespace/old/options", strings.NewReader(`{"mode": "archived"}`), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	vol.mu.RLock()
+	assert.Nil(t, vol.dbs["old"].db)
+	vol.mu.RUnlock()
+	var sr StatusResponse
+	rr = doRequest(vol, "GET", "/status", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &sr)
+	assert.Equal(t, ModeArchived, sr.Summary["old"].Mode)
+
+	// opened on the first access
+	rr = doRequest(vol, "GET", "/old/one", nil, nil)
+	assert.Equal(t, "hello", rr.Body.String())
+	rr = doRequest(vol, "POST", "/old/two", strings.NewReader("world"), nil)
+	assert.Equal(t, http.StatusLocked, rr.Code)
+
+	rr = doRequest(vol, "PUT", "/v1/namespace/old/options", strings.NewReader(`{"mode": "rw"}`), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = doRequest(vol, "PUT", "/old/two", strings.NewReader("world"), nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	rr = doRequest(vol, "PUT", "/v1/namespace/old/options", strings.NewReader(`{"mode": "frozen"}`), nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// the mode is changed once the requests using the namespace finish,
+	// the event streams are closed so the clients reconnect
+	srv := httptest.NewServer(vol.r)
+	defer srv.Close()
+	rsp, err := http.Get(srv.URL + "/v1/namespace/old/_events")
+	assert.Nil(t, err)
+	defer rsp.Body.Close()
+	h := vol.acquire("old")
+	changed := make(chan int)
+	go func() {
+		rr := doRequest(vol, "PUT", "/v1/namespace/old/options", strings.NewReader(`{"mode": "ro"}`), nil)
+		changed <- rr.Code
+	}()
+	select {
+	case <-changed:
+		t.Fatal("mode changed while the namespace is used")
+	case <-time.After(100 * time.Millisecond):
+	}
+	vol.release(h)
+	assert.Equal(t, http.StatusOK, <-changed)
+	_, err = io.ReadAll(rsp.Body)
+	assert.Nil(t, err)
+	rr = doRequest(vol, "GET", "/old/two", nil, nil)
+	assert.Equal(t, "world", rr.Body.String())
+}
+
+func TestLazyOpen(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NSDir = t.TempDir()
+	cfg.MaxOpenNS = 2
+	vol := New(WithConfig(cfg))
+	for _, ns := range []string{"a", "b"} {
+		doRequest(vol, "POST", "/v1/namespace", strings.NewReader(`{"name": "`+ns+`"}`), nil)
+		rr := doRequest(vol, "PUT", "/"+ns+"/one", strings.NewReader(ns), nil)
+		assert.Equal(t, http.StatusCreated, rr.Code)
+	}
+	// default was the least recently used
+	assert.Nil(t, vol.dbs["default"].db)
+
+	// a reference keeps the namespace open
+	h := vol.acquire("a")
+	assert.NotNil(t, h)
+	rr := doRequest(vol, "GET", "/default/one", nil, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.NotNil(t, vol.dbs["a"].db)
+	assert.Nil(t, vol.dbs["b"].db)
+	vol.release(h)
+
+	vol.closeIdle(0)
+	for _, ns := range []string{"default", "a", "b"} {
+		assert.Nil(t, vol.dbs[ns].db)
+	}
+	var sr StatusResponse
+	rr = doRequest(vol, "GET", "/status", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &sr)
+	assert.True(t, sr.Summary["a"].Closed)
+
+	rr = doRequest(vol, "GET", "/a/one", nil, nil)
+	assert.Equal(t, "a", rr.Body.String())
+
+	// the callers which come while it's opened wait for the same files
+	vol.closeIdle(0)
+	dbs := make(chan *store.DB)
+	for i := 0; i < 8; i++ {
+		go func() {
+			db, _ := vol.nsDB("b")
+			dbs <- db
+		}()
+	}
+	first := <-dbs
+	assert.NotNil(t, first)
+	for i := 1; i < 8; i++ {
+		assert.Same(t, first, <-dbs)
+	}
+	vol.mu.RLock()
+	assert.Equal(t, 0, vol.dbs["b"].refs)
+	assert.Nil(t, vol.dbs["b"].opening)
+	vol.mu.RUnlock()
+}
+
+func TestWatch(t *testing.T) {
+	watchSettle = 100 * time.Millisecond
+	cfg := DefaultConfig()
+	cfg.NSDir = t.TempDir()
+	cfg.Watch = true
+	vol := New(WithConfig(cfg))
+
+	hasNS := func(ns string) bool {
+		for _, n := range vol.nsNames() {
+			if n == ns {
+				return true
+			}
+		}
+		return false
+	}
+	store.CreateDB(filepath.Join(cfg.NSDir, "copied"), dataSchemaV1).Close()
+	os.WriteFile(filepath.Join(cfg.NSDir, "garbage.db"), []byte("not sqlite"), 0644)
+	assert.Eventually(t, func() bool { return hasNS("copied") }, 5*time.Second, 50*time.Millisecond)
+	assert.False(t, hasNS("garbage"))
+
+	rr := doRequest(vol, "PUT", "/copied/one", strings.NewReader("hello"), nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	os.Remove(filepath.Join(cfg.NSDir, "copied.db"))
+	assert.Eventually(t, func() bool { return !hasNS("copied") }, 5*time.Second, 50*time.Millisecond)
+	rr = doRequest(vol, "GET", "/copied/one", nil, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// a file copied back while the removed namespace is in use is
+	// registered once it's released
+	store.CreateDB(filepath.Join(cfg.NSDir, "again"), dataSchemaV1).Close()
+	assert.Eventually(t, func() bool { return hasNS("again") }, 5*time.Second, 50*time.Millisecond)
+	h := vol.acquire("again")
+	os.Remove(filepath.Join(cfg.NSDir, "again.db"))
+	assert.Eventually(t, func() bool { return !hasNS("again") }, 5*time.Second, 50*time.Millisecond)
+	store.CreateDB(filepath.Join(cfg.NSDir, "again"), dataSchemaV1).Close()
+	time.Sleep(3 * watchSettle)
+	assert.False(t, hasNS("again"))
+	vol.release(h)
+	assert.Eventually(t, func() bool { return hasNS("again") }, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestDownload(t *testing.T) {
+	vol := newTestVolume(t)
+	for i := 0; i < 10; i++ {
+		doRequest(vol, "PUT", fmt.Sprintf("/default/k%d", i), strings.NewReader("hello"), nil)
+	}
+	open := func(b []byte) *store.DB {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "copy.db"), b, 0644)
+		db, err := store.OpenDB(filepath.Join(dir, "copy"), store.DefaultSQLiteOptions())
+		assert.Nil(t, err)
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+
+	rr := doRequest(vol, "GET", "/v1/namespace/default/_download", nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var n int
+	open(rr.Body.Bytes()).Get(&n, "SELECT count(*) FROM data")
+	assert.Equal(t, 10, n)
+
+	rr = doRequest(vol, "GET", "/files/default.db?compress=gzip", nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/gzip", rr.Header().Get("Content-Type"))
+	gz, err := gzip.NewReader(rr.Body)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(gz)
+	open(b).Get(&n, "SELECT count(*) FROM data")
+	assert.Equal(t, 10, n)
+
+	// the partitions and archived files are sent as snapshots too
+	doRequest(vol, "PUT", "/v1/namespace/default/options",
+		strings.NewReader(`{"partition": {"by": "size", "maxBytes": 1}}`), nil)
+	for _, k := range []string{"a", "b"} {
+		doRequest(vol, "PUT", "/default/"+k, strings.NewReader(k), nil)
+	}
+	var parts []PartitionInfo
+	rr = doRequest(vol, "GET", "/v1/namespace/default/partitions", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &parts)
+	assert.Equal(t, 2, len(parts))
+	rr = doRequest(vol, "GET", "/files/default/"+parts[1].Name+".db", nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	open(rr.Body.Bytes()).Get(&n, "SELECT count(*) FROM data")
+	assert.Equal(t, 1, n)
+	doRequest(vol, "POST", "/v1/namespace/default/partitions/"+parts[0].Name+"/_archive", nil, nil)
+	rr = doRequest(vol, "GET", "/files/_archive/default/"+parts[0].Name+".db", nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	open(rr.Body.Bytes()).Get(&n, "SELECT count(*) FROM data")
+	assert.Equal(t, 1, n)
+
+	for _, name := range []string{"default.db-wal", "default.db-shm", "_upload/default-1.db", "_upload/"} {
+		rr = doRequest(vol, "GET", "/files/"+name, nil, nil)
+		assert.Equal(t, http.StatusNotFound, rr.Code, name)
+	}
+	rr = doRequest(vol, "GET", "/files/", nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "default.db")
+	assert.NotContains(t, rr.Body.String(), "-wal")
+
+	// no snapshots left behind
+	files, _ := filepath.Glob(filepath.Join(vol.cfg.NSDir, snapshotPrefix+"*"))
+	assert.Empty(t, files)
+	rr = doRequest(vol, "GET", "/v1/namespace/nope/_download", nil, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestUpload(t *testing.T) {
+	vol := newTestVolume(t)
+	doRequest(vol, "PUT", "/default/one", strings.NewReader("hello"), nil)
+	snap := doRequest(vol, "GET", "/v1/namespace/default/_download", nil, nil).Body.Bytes()
+
+	rr := doRequest(vol, "PUT", "/v1/namespace/copy/_upload", bytes.NewReader(snap), nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	rr = doRequest(vol, "GET", "/copy/one", nil, nil)
+	assert.Equal(t, "hello", rr.Body.String())
+	doRequest(vol, "PUT", "/copy/two", strings.NewReader("two"), nil)
+	doRequest(vol, "PUT", "/copy/three", strings.NewReader("three"), nil)
+
+	// an old file is migrated, gzip is accepted
+	old := filepath.Join(t.TempDir(), "old")
+	db := store.CreateDB(old, dataSchemaV1)
+	db.MustExec("INSERT INTO data (data_id, data) VALUES ('legacy', x'00')")
+	db.Close()
+	b, _ := os.ReadFile(old + ".db")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(b)
+	gz.Close()
+	rr = doRequest(vol, "PUT", "/v1/namespace/copy/_upload", &buf, map[string]string{"Content-Encoding": "gzip"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = doRequest(vol, "GET", "/copy/one", nil, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	var ids DataIDResponse
+	rr = doRequest(vol, "GET", "/v1/data/copy/_list", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &ids)
+	assert.Equal(t, 1, ids.Total)
+
+	// the changelog goes on after the last number of the replaced file,
+	// consumers of the old one get 410 and sync again
+	for _, since := range []string{"0", "3"} {
+		rr = doRequest(vol, "GET", "/v1/data/copy/_changes?since="+since, nil, nil)
+		assert.Equal(t, http.StatusGone, rr.Code)
+	}
+	rr = doRequest(vol, "GET", "/v1/data/copy/_changes?since=4", nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	doRequest(vol, "PUT", "/copy/four", strings.NewReader("four"), nil)
+	var page ChangesResponse
+	rr = doRequest(vol, "GET", "/v1/data/copy/_changes?since=4", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	if assert.Len(t, page.Changes, 1) {
+		assert.Equal(t, int64(5), page.Changes[0].Seq)
+	}
+	doRequest(vol, "DELETE", "/copy/four", nil, nil)
+
+	rr = doRequest(vol, "PUT", "/v1/namespace/bad/_upload", strings.NewReader("not sqlite"), nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	rr = doRequest(vol, "PUT", "/v1/namespace/_archive/_upload", bytes.NewReader(snap), nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.NotContains(t, vol.nsNames(), "bad")
+
+	// files over the limit are rejected, before and after decompressing
+	vol.cfg.MaxUploadSize = int64(len(snap) - 1)
+	rr = doRequest(vol, "PUT", "/v1/namespace/big/_upload", bytes.NewReader(snap), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	rr = doRequest(vol, "PUT", "/v1/namespace/big/_upload", io.MultiReader(bytes.NewReader(snap)), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	buf.Reset()
+	gz = gzip.NewWriter(&buf)
+	gz.Write(snap)
+	gz.Close()
+	assert.Less(t, buf.Len(), len(snap)-1)
+	rr = doRequest(vol, "PUT", "/v1/namespace/big/_upload", &buf, map[string]string{"Content-Encoding": "gzip"})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.NotContains(t, vol.nsNames(), "big")
+	tmps, _ := os.ReadDir(filepath.Join(vol.cfg.NSDir, uploadDir))
+	assert.Empty(t, tmps)
+	vol.cfg.MaxUploadSize = 0
+
+	// read-only and archived namespaces are not replaced
+	for _, mode := range []string{ModeReadOnly, ModeArchived} {
+		rr = doRequest(vol, "PUT", "/v1/namespace/copy/options",
+			strings.NewReader(fmt.Sprintf(`{"mode": %q}`, mode)), nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		rr = doRequest(vol, "PUT", "/v1/namespace/copy/_upload", bytes.NewReader(snap), nil)
+		assert.Equal(t, http.StatusLocked, rr.Code)
+		vol.mu.Lock()
+		vol.closeNS("copy", vol.dbs["copy"])
+		vol.mu.Unlock()
+		status, err := vol.replaceNS("copy", filepath.Join(t.TempDir(), "copy.db"), 1)
+		assert.Equal(t, http.StatusLocked, status)
+		assert.Error(t, err)
+	}
+	rr = doRequest(vol, "GET", "/v1/data/copy/_list", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &ids)
+	assert.Equal(t, 1, ids.Total)
+}
+
+func TestOutbox(t *testing.T) {
+	// nothing listens there, so the events are kept in the outbox
+	p := store.NewProducer(store.WithRedis(&store.Redis{Conn: &store.Connection{Addr: "127.0.0.1:1"}}))
+	p.Namespace = "RD"
+	cfg := DefaultConfig()
+	cfg.NSDir = t.TempDir()
+	vol := New(WithConfig(cfg), WithProducer(p))
+
+	headers := map[string]string{"X-Request-Id": "req-1"}
+	doRequest(vol, "PUT", "/default/one", strings.NewReader("hello"), headers)
+	doRequest(vol, "PUT", "/default/one", strings.NewReader("hello world"), headers)
+	doRequest(vol, "DELETE", "/default/one", nil, headers)
+
+	db, _ := vol.nsDB("default")
+	rows := []string{}
+	db.Select(&rows, "SELECT event FROM outbox ORDER BY id")
+	assert.Len(t, rows, 3)
+	types := []string{}
+	for _, row := range rows {
+		var e Event
+		json.Unmarshal([]byte(row), &e)
+		assert.Equal(t, "one", e.Key)
+		assert.Equal(t, "req-1", e.RequestID)
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{EventCreated, EventUpdated, EventDeleted}, types)
+
+	// deletes carry the size and checksum of the removed version
+	var e Event
+	json.Unmarshal([]byte(rows[2]), &e)
+	sum := sha256.Sum256([]byte("hello world"))
+	v := e.values()
+	assert.Equal(t, EventDeleted, v["type"])
+	assert.Equal(t, "one", v["path"])
+	assert.Equal(t, int64(11), v["size"])
+	assert.Equal(t, hex.EncodeToString(sum[:]), v["checksum"])
+	assert.Equal(t, "req-1", v["request_id"])
+
+	sent, err := vol.relayDB(context.Background(), "default", db)
+	assert.Equal(t, 0, sent)
+	assert.NotNil(t, err)
+	var pending int
+	db.Get(&pending, "SELECT count(*) FROM outbox WHERE sent_at IS NULL")
+	assert.Equal(t, 3, pending)
+
+	assert.Equal(t, 2*time.Second, backoff(1))
+	assert.Equal(t, relayMaxBackoff, backoff(30))
+}
+
+func TestChanges(t *testing.T) {
+	vol := newTestVolume(t)
+
+	doRequest(vol, "PUT", "/default/one", strings.NewReader("hello"), nil)
+	doRequest(vol, "PUT", "/default/one", strings.NewReader("hello world"), nil)
+	doRequest(vol, "DELETE", "/default/one", nil, nil)
+
+	rr := doRequest(vol, "GET", "/v1/data/default/_changes?since=0", nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var page ChangesResponse
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	assert.Len(t, page.Changes, 3)
+	assert.Equal(t, int64(3), page.Last)
+	types := []string{}
+	for i, c := range page.Changes {
+		assert.Equal(t, int64(i+1), c.Seq)
+		assert.Equal(t, "one", c.Key)
+		types = append(types, c.Type)
+	}
+	assert.Equal(t, []string{EventCreated, EventUpdated, EventDeleted}, types)
+
+	rr = doRequest(vol, "GET", "/v1/data/default/_changes?since=2", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	assert.Len(t, page.Changes, 1)
+
+	// a long poll returns when the next change is committed
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- doRequest(vol, "GET", "/v1/data/default/_changes?since=3&wait=10s", nil, nil)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	doRequest(vol, "PUT", "/default/two", strings.NewReader("two"), nil)
+	select {
+	case rr = <-done:
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		assert.Len(t, page.Changes, 1)
+		assert.Equal(t, int64(4), page.Last)
+	case <-time.After(5 * time.Second):
+		t.Fatal("long poll didn't return")
+	}
+
+	// the sequence is kept when the namespace is opened again
+	vol.mu.Lock()
+	vol.closeNS("default", vol.dbs["default"])
+	vol.dbs["default"].changes = nil
+	vol.mu.Unlock()
+	doRequest(vol, "PUT", "/default/three", strings.NewReader("three"), nil)
+	rr = doRequest(vol, "GET", "/v1/data/default/_changes?since=4", nil, nil)
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	assert.Len(t, page.Changes, 1)
+	assert.Equal(t, int64(5), page.Last)
+
+	db, _ := vol.nsDB("default")
+	assert.Nil(t, vol.pruneChanges(context.Background(), "default", db, -time.Hour))
+	rr = doRequest(vol, "GET", "/v1/data/default/_changes?since=0", nil, nil)
+	assert.Equal(t, http.StatusGone, rr.Code)
+	rr = doRequest(vol, "GET", "/v1/data/default/_changes?since=5", nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestEvents(t *testing.T) {
+	vol := newTestVolume(t)
+	srv := httptest.NewServer(vol.r)
+	defer srv.Close()
+
+	doRequest(vol, "PUT", "/default/a1", strings.NewReader("a1"), nil)
+	doRequest(vol, "PUT", "/default/b1", strings.NewReader("b1"), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/v1/namespace/default/_events?prefix=a", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	rsp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, "text/event-stream", rsp.Header.Get("Content-Type"))
+
+	// the missed change and then the new one, b1 is filtered out
+	doRequest(vol, "PUT", "/default/a2", strings.NewReader("a2"), nil)
+	sc := bufio.NewScanner(rsp.Body)
+	lines := []string{}
+	for len(lines) < 6 && sc.Scan() {
+		if sc.Text() != "" {
+			lines = append(lines, sc.Text())
+		}
+	}
+	assert.Equal(t, "id: 1", lines[0])
+	assert.Equal(t, "event: created", lines[1])
+	assert.Contains(t, lines[2], `"path":"a1"`)
+	assert.Equal(t, "id: 3", lines[3])
+	assert.Contains(t, lines[5], `"path":"a2"`)
+
+	rr := doRequest(vol, "GET", "/v1/namespace/default/_events?since=x", nil, nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestHooks(t *testing.T) {
+	vol := newTestVolume(t)
+
+	received := make(chan Event, 10)
+	var secret string
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-RD-Signature") != sign(secret, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var e Event
+		json.Unmarshal(body, &e)
+		received <- e
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	rr := doRequest(vol, "POST", "/v1/namespace/default/_hooks",
+		strings.NewReader(`{"url": "ftp://example.com"}`), nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = doRequest(vol, "POST", "/v1/namespace/default/_hooks",
+		strings.NewReader(fmt.Sprintf(`{"url": %q, "prefix": "a", "events": ["created"]}`, ok.URL)), nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var hook Hook
+	json.Unmarshal(rr.Body.Bytes(), &hook)
+	assert.NotEmpty(t, hook.Secret)
+	secret = hook.Secret
+
+	rr = doRequest(vol, "POST", "/v1/namespace/default/_hooks/"+hook.ID+"/_test", nil, nil)
+	var res DeliveryResponse
+	json.Unmarshal(rr.Body.Bytes(), &res)
+	assert.Equal(t, 1, res.Delivered)
+	assert.Equal(t, EventTest, (<-received).Type)
+
+	doRequest(vol, "PUT", "/default/b1", strings.NewReader("b1"), nil)
+	doRequest(vol, "PUT", "/default/a1", strings.NewReader("a1"), nil)
+	doRequest(vol, "PUT", "/default/a1", strings.NewReader("a1 again"), nil)
+	select {
+	case e := <-received:
+		assert.Equal(t, "a1", e.Key)
+		assert.Equal(t, EventCreated, e.Type)
+		assert.Equal(t, "default", e.Namespace)
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook not delivered")
+	}
+
+	// deliveries which fail are moved to the dead letters
+	hookMaxAttempts = 1
+	defer func() { hookMaxAttempts = 8 }()
+	rr = doRequest(vol, "POST", "/v1/namespace/default/_hooks",
+		strings.NewReader(fmt.Sprintf(`{"url": %q}`, failing.URL)), nil)
+	json.Unmarshal(rr.Body.Bytes(), &hook)
+	doRequest(vol, "PUT", "/default/c1", strings.NewReader("c1"), nil)
+	dead := []DeadLetter{}
+	for i := 0; i < 50 && len(dead) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		rr = doRequest(vol, "GET", "/v1/namespace/default/_hooks/"+hook.ID+"/dead", nil, nil)
+		json.Unmarshal(rr.Body.Bytes(), &dead)
+	}
+	assert.Len(t, dead, 1)
+	assert.Equal(t, "status 500", dead[0].LastError)
+
+	rr = doRequest(vol, "GET", "/v1/namespace/default/_hooks", nil, nil)
+	hooks := []Hook{}
+	json.Unmarshal(rr.Body.Bytes(), &hooks)
+	assert.Len(t, hooks, 2)
+	assert.Empty(t, hooks[0].Secret)
+
+	rr = doRequest(vol, "DELETE", "/v1/namespace/default/_hooks/"+hook.ID, nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = doRequest(vol, "GET", "/v1/namespace/default/_hooks/"+hook.ID, nil, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// a hook which doesn't answer doesn't delay the others
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	doRequest(vol, "POST", "/v1/namespace", strings.NewReader(`{"name": "slow"}`), nil)
+	rr = doRequest(vol, "POST", "/v1/namespace/slow/_hooks",
+		strings.NewReader(fmt.Sprintf(`{"url": %q}`, slow.URL)), nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	doRequest(vol, "PUT", "/slow/s1", strings.NewReader("s1"), nil)
+	time.Sleep(100 * time.Millisecond)
+	doRequest(vol, "PUT", "/default/a2", strings.NewReader("a2"), nil)
+	select {
+	case e := <-received:
+		assert.Equal(t, "a2", e.Key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook delayed by a slow one")
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	p := store.NewMemoryPublisher()
+	p.Fail(errors.New("sink down"))
+	cfg := DefaultConfig()
+	cfg.NSDir = t.TempDir()
+	vol := New(WithConfig(cfg), WithPublisher(p))
+
+	doRequest(vol, "PUT", "/default/one", strings.NewReader("hello"), nil)
+	doRequest(vol, "DELETE", "/default/one", nil, nil)
+	db, _ := vol.nsDB("default")
+	var attempts int
+	for i := 0; i < 50 && attempts == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		db.Get(&attempts, "SELECT coalesce(max(attempts), 0) FROM outbox")
+	}
+	assert.Equal(t, 1, attempts)
+	assert.Len(t, p.Messages(), 0)
+
+	// the events are kept in order until the sink works again
+	p.Fail(nil)
+	db.W.MustExec("UPDATE outbox SET next_at = NULL")
+	vol.wakeRelay()
+	var msgs []store.Message
+	for i := 0; i < 50 && len(msgs) < 2; i++ {
+		time.Sleep(50 * time.Millisecond)
+		msgs = p.Messages()
+	}
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, "default", msgs[0].Namespace)
+	assert.Equal(t, EventCreated, msgs[0].Values["type"])
+	assert.Equal(t, EventDeleted, msgs[1].Values["type"])
+	assert.Equal(t, int64(2), msgs[1].Values["seq"])
+
+	// the events left in a read-only namespace are sent too, and marked
+	// as sent once it's writable again
+	p.Fail(errors.New("sink down"))
+	doRequest(vol, "PUT", "/default/two", strings.NewReader("hello"), nil)
+	rr := doRequest(vol, "PUT", "/v1/namespace/default/options", strings.NewReader(`{"mode": "ro"}`), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	p.Fail(nil)
+	for i := 0; i < 100 && len(msgs) < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		vol.wakeRelay()
+		msgs = p.Messages()
+	}
+	assert.Len(t, msgs, 3)
+	assert.Equal(t, "two", msgs[2].Values["path"])
+	rr = doRequest(vol, "PUT", "/v1/namespace/default/options", strings.NewReader(`{"mode": "rw"}`), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	db, _ = vol.nsDB("default")
+	pending := 1
+	for i := 0; i < 50 && pending > 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		vol.wakeRelay()
+		db.Get(&pending, "SELECT count(*) FROM outbox WHERE sent_at IS NULL")
+	}
+	assert.Equal(t, 0, pending)
+	assert.Len(t, p.Messages(), 3)
 }
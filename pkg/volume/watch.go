@@ -0,0 +1,183 @@
+package volume
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/algorinfo/rawstore/pkg/store"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchSettle time without changes in a new file before it's checked,
+// so files still being copied are not registered.
+var watchSettle = 2 * time.Second
+
+// validNSFile checks that a sqlite file could be used as a namespace,
+// check is quick_check or integrity_check.
+func validNSFile(path, check string) error {
+	opts := store.DefaultSQLiteOptions()
+	opts.ReadOnly = true
+	db, err := store.OpenDB(strings.TrimSuffix(path, ".db"), opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var res string
+	if err := db.Get(&res, "PRAGMA "+check); err != nil {
+		return err
+	}
+	if res != "ok" {
+		return fmt.Errorf("%s: %s", check, res)
+	}
+	var version int
+	if err := db.Get(&version, "PRAGMA user_version"); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than %d", version, len(migrations))
+	}
+	var cols []string
+	if err := db.Select(&cols, "SELECT name FROM pragma_table_info('data')"); err != nil {
+		return err
+	}
+	required := map[string]bool{"data_id": false, "data": false, "created_at": false}
+	for _, c := range cols {
+		if _, ok := required[c]; ok {
+			required[c] = true
+		}
+	}
+	for c, found := range required {
+		if !found {
+			return fmt.Errorf("table data without column %s", c)
+		}
+	}
+	return nil
+}
+
+// registerNS adds a namespace found in the dir, it's opened on the first use
+func (wa *WebApp) registerNS(ns string) bool {
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	if _, ok := wa.dbs[ns]; ok {
+		return false
+	}
+	wa.dbs[ns] = &nsHandle{name: ns}
+	wa.namespaces = append(wa.namespaces, ns)
+	return true
+}
+
+// unregisterNS removes a namespace whose file is gone,
+// it's closed once the requests using it finish.
+func (wa *WebApp) unregisterNS(ns string) {
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	h, ok := wa.dbs[ns]
+	if !ok || h.removed {
+		return
+	}
+	for i, name := range wa.namespaces {
+		if name == ns {
+			wa.namespaces = append(wa.namespaces[:i], wa.namespaces[i+1:]...)
+			break
+		}
+	}
+	h.removed = true
+	if h.refs == 0 {
+		wa.closeNS(ns, h)
+		delete(wa.dbs, ns)
+	}
+}
+
+/*
+Watch registers the namespace files copied into NSDir and removes the
+namespaces whose file is deleted or moved out, without a restart.
+New files are validated when they stop changing.
+*/
+func (wa *WebApp) Watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(wa.cfg.NSDir); err != nil {
+		w.Close()
+		return err
+	}
+	go wa.watchLoop(w)
+	return nil
+}
+
+func (wa *WebApp) watchLoop(w *fsnotify.Watcher) {
+	defer w.Close()
+	// pending new files and the time of its last change
+	pending := map[string]time.Time{}
+	tick := time.NewTicker(watchSettle / 2)
+	defer tick.Stop()
+
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			name := filepath.Base(ev.Name)
+			if !strings.HasSuffix(name, ".db") {
+				continue
+			}
+			ns := strings.TrimSuffix(name, ".db")
+			if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				delete(pending, ns)
+				if _, err := os.Stat(ev.Name); os.IsNotExist(err) {
+					log.Printf("Namespace file %s removed", name)
+					wa.unregisterNS(ns)
+				}
+				continue
+			}
+			if ev.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+				wa.mu.RLock()
+				h, known := wa.dbs[ns]
+				removed := known && h.removed
+				wa.mu.RUnlock()
+				if !known || removed {
+					pending[ns] = time.Now()
+				}
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Error watching %s: %s", wa.cfg.NSDir, err)
+		case <-tick.C:
+			for ns, last := range pending {
+				if time.Since(last) < watchSettle {
+					continue
+				}
+				wa.mu.RLock()
+				h, known := wa.dbs[ns]
+				removed := known && h.removed
+				wa.mu.RUnlock()
+				if removed {
+					// a namespace removed is still in use, try it later
+					continue
+				}
+				delete(pending, ns)
+				if known {
+					// registered meanwhile, by an upload or a request
+					continue
+				}
+				path := filepath.Join(wa.cfg.NSDir, ns+".db")
+				if err := validNSFile(path, "quick_check"); err != nil {
+					log.Printf("Ignoring %s: %s", path, err)
+					continue
+				}
+				if wa.registerNS(ns) {
+					log.Printf("NS Loading for %s", ns)
+				}
+			}
+		}
+	}
+}